@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	corev1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/core/v1"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	k8scorev1 "k8s.io/api/core/v1"
+)
+
+var authenticationModes = []string{"CONFIG_MAP", "API_AND_CONFIG_MAP", "API"}
+
+// EKS managed access policies by the name used in config
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/access-policies.html#access-policy-permissions
+var accessPolicies = map[string]string{
+	"clusterAdmin": "arn:aws:eks::aws:cluster-access-policy/AmazonEKSClusterAdminPolicy",
+	"admin":        "arn:aws:eks::aws:cluster-access-policy/AmazonEKSAdminPolicy",
+	"edit":         "arn:aws:eks::aws:cluster-access-policy/AmazonEKSEditPolicy",
+	"view":         "arn:aws:eks::aws:cluster-access-policy/AmazonEKSViewPolicy",
+}
+
+// aws-auth is ignored once the cluster only authenticates through access entries
+func awsAuthEnabled(access *Access) bool {
+	return access.AuthenticationMode != "API"
+}
+
+// Cluster accessConfig, nil leaves the cluster on the EKS default of aws-auth only
+func clusterAccessConfig(access *Access) (*eksClusterAccessConfigArgs, error) {
+	if access.AuthenticationMode == "" {
+		if len(access.Entries) > 0 {
+			return nil, fmt.Errorf("access entries need access.authenticationMode set to API or API_AND_CONFIG_MAP")
+		}
+		return nil, nil
+	}
+	if !contains(authenticationModes, access.AuthenticationMode) {
+		return nil, fmt.Errorf("access.authenticationMode must be one of %v", authenticationModes)
+	}
+	if access.AuthenticationMode == "CONFIG_MAP" && len(access.Entries) > 0 {
+		return nil, fmt.Errorf("access entries are ignored by a cluster in CONFIG_MAP mode")
+	}
+	return &eksClusterAccessConfigArgs{
+		AuthenticationMode: pulumi.String(access.AuthenticationMode),
+	}, nil
+}
+
+// Access entries and their policy associations, created right after the cluster. The returned entries are the ones nodes need to join.
+func setupAccessEntries(ctx *pulumi.Context, eksCluster *eks.Cluster, eksConfig *eksConfig, nodeRole *iam.Role) ([]pulumi.Resource, error) {
+	deps := []pulumi.Resource{}
+	access := &eksConfig.Access
+	// EKS adds the node role entry for managed node groups only, Karpenter launches its nodes with that role on its own.
+	// Without entries (CONFIG_MAP) the node role is mapped in aws-auth instead.
+	// Docs: https://docs.aws.amazon.com/eks/latest/userguide/creating-access-entries.html
+	if karpenterEnabled(eksConfig) && access.AuthenticationMode != "" && access.AuthenticationMode != "CONFIG_MAP" {
+		entry, err := newEksAccessEntry(ctx, "access-karpenter-node", &eksAccessEntryArgs{
+			ClusterName:  eksCluster.Name,
+			PrincipalArn: nodeRole.Arn,
+			Type:         pulumi.String("EC2_LINUX"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, entry)
+	}
+
+	for _, e := range access.Entries {
+		policyArn, ok := accessPolicies[e.Policy]
+		if !ok {
+			return nil, fmt.Errorf("access entry %s: unknown policy %q, valid policies are clusterAdmin, admin, edit and view", e.PrincipalArn, e.Policy)
+		}
+		name := accessEntryName(e.PrincipalArn)
+
+		entryArgs := &eksAccessEntryArgs{
+			ClusterName:  eksCluster.Name,
+			PrincipalArn: pulumi.String(e.PrincipalArn),
+			Type:         pulumi.String("STANDARD"),
+		}
+		if len(e.KubernetesGroups) > 0 {
+			entryArgs.KubernetesGroups = toPulumiStringArray(e.KubernetesGroups)
+		}
+		if e.Username != "" {
+			entryArgs.UserName = pulumi.String(e.Username)
+		}
+		entry, err := newEksAccessEntry(ctx, "access-"+name, entryArgs)
+		if err != nil {
+			return nil, err
+		}
+
+		scope := &eksAccessScopeArgs{Type: pulumi.String("cluster")}
+		if len(e.Namespaces) > 0 {
+			scope = &eksAccessScopeArgs{
+				Type:       pulumi.String("namespace"),
+				Namespaces: toPulumiStringArray(e.Namespaces),
+			}
+		}
+		_, err = newEksAccessPolicyAssociation(ctx, "access-"+name+"-"+e.Policy, &eksAccessPolicyAssociationArgs{
+			ClusterName:  eksCluster.Name,
+			PrincipalArn: entry.PrincipalArn,
+			PolicyArn:    pulumi.String(policyArn),
+			AccessScope:  scope,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+// arn:aws:iam::123456789012:role/team/admins becomes role-team-admins
+func accessEntryName(principalArn string) string {
+	parts := strings.SplitN(principalArn, ":", 6)
+	return strings.ReplaceAll(parts[len(parts)-1], "/", "-")
+}
+
+// Entries of the mapRoles and mapUsers keys, as read by aws-iam-authenticator
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/add-user-role.html
+type awsAuthRole struct {
+	RoleArn  string   `json:"rolearn" yaml:"rolearn"`
+	Username string   `json:"username" yaml:"username"`
+	Groups   []string `json:"groups" yaml:"groups"`
+}
+
+type awsAuthUser struct {
+	UserArn  string   `json:"userarn" yaml:"userarn"`
+	Username string   `json:"username" yaml:"username"`
+	Groups   []string `json:"groups" yaml:"groups"`
+}
+
+// Resource: aws-auth ConfigMap
+// Purpose: Maps IAM roles and users to Kubernetes identities, including the node and Fargate roles EKS would add itself.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/add-user-role.html
+func setupAwsAuth(ctx *pulumi.Context, k8sProvider *providers.Provider, kubeconfig pulumi.StringOutput, nodeRole *iam.Role, fargateRole *iam.Role, access *Access) (*corev1.ConfigMap, error) {
+	systemRoleArns := pulumi.StringArray{nodeRole.Arn}
+	if fargateRole != nil {
+		systemRoleArns = append(systemRoleArns, fargateRole.Arn)
+	}
+
+	mapRoles := systemRoleArns.ToStringArrayOutput().ApplyT(func(arns []string) (string, error) {
+		systemRoles := []awsAuthRole{
+			{arns[0], "system:node:{{EC2PrivateDNSName}}", []string{"system:bootstrappers", "system:nodes"}},
+		}
+		if len(arns) > 1 {
+			systemRoles = append(systemRoles, awsAuthRole{arns[1], "system:node:{{SessionName}}", []string{"system:bootstrappers", "system:nodes", "system:node-proxier"}})
+		}
+		return renderAwsAuthRoles(systemRoles, access.RoleMappings)
+	}).(pulumi.StringOutput)
+
+	mapUsers, err := renderAwsAuthUsers(access.UserMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything EKS would add for nodes is already in here, mappings other tools added since the last update
+	// are read back from the cluster and kept. Previews don't call the cluster, they show the mappings from config.
+	live := kubeconfig.ApplyT(func(kubeconfig string) (*k8scorev1.ConfigMap, error) {
+		if ctx.DryRun() {
+			return nil, nil
+		}
+		client, err := newKubernetesClient(kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return readAwsAuth(context.Background(), client)
+	})
+	merged := pulumi.All(mapRoles, live).ApplyT(func(args []interface{}) (*k8scorev1.ConfigMap, error) {
+		return mergeAwsAuth(args[1].(*k8scorev1.ConfigMap), args[0].(string), mapUsers)
+	})
+
+	// The provider applies server-side, so the aws-auth EKS creates for managed node groups is taken over rather
+	// than failing the create. patchForce takes the fields EKS wrote.
+	// Docs: https://www.pulumi.com/registry/packages/kubernetes/how-to-guides/managing-resources-with-server-side-apply/
+	return corev1.NewConfigMap(ctx, "aws-auth", &corev1.ConfigMapArgs{
+		Metadata: &metav1.ObjectMetaArgs{
+			Name:      pulumi.String("aws-auth"),
+			Namespace: pulumi.String("kube-system"),
+			Annotations: merged.ApplyT(func(v interface{}) map[string]string {
+				annotations := map[string]string{"pulumi.com/patchForce": "true"}
+				for k, v := range v.(*k8scorev1.ConfigMap).Annotations {
+					annotations[k] = v
+				}
+				return annotations
+			}).(pulumi.StringMapOutput),
+		},
+		Data: merged.ApplyT(func(v interface{}) map[string]string {
+			return v.(*k8scorev1.ConfigMap).Data
+		}).(pulumi.StringMapOutput),
+	}, pulumi.Provider(k8sProvider))
+}
+
+// The node and Fargate mappings always come first and can't be remapped from config, or nodes would stop joining
+func renderAwsAuthRoles(systemRoles []awsAuthRole, mappings []RoleMapping) (string, error) {
+	roles := append([]awsAuthRole{}, systemRoles...)
+	seen := map[string]bool{}
+	for _, r := range systemRoles {
+		seen[r.RoleArn] = true
+	}
+	for _, m := range mappings {
+		if m.RoleArn == "" || m.Username == "" {
+			return "", fmt.Errorf("role mappings need a roleArn and a username")
+		}
+		if seen[m.RoleArn] {
+			return "", fmt.Errorf("role %s is mapped more than once", m.RoleArn)
+		}
+		seen[m.RoleArn] = true
+		roles = append(roles, awsAuthRole{m.RoleArn, m.Username, append([]string{}, m.Groups...)})
+	}
+	// JSON is valid YAML, and doesn't need a YAML library
+	res, err := json.Marshal(roles)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+func renderAwsAuthUsers(mappings []UserMapping) (string, error) {
+	users := []awsAuthUser{}
+	seen := map[string]bool{}
+	for _, m := range mappings {
+		if m.UserArn == "" || m.Username == "" {
+			return "", fmt.Errorf("user mappings need a userArn and a username")
+		}
+		if seen[m.UserArn] {
+			return "", fmt.Errorf("user %s is mapped more than once", m.UserArn)
+		}
+		seen[m.UserArn] = true
+		users = append(users, awsAuthUser{m.UserArn, m.Username, append([]string{}, m.Groups...)})
+	}
+	res, err := json.Marshal(users)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
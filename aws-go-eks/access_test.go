@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderAwsAuthRoles(t *testing.T) {
+	nodeRole := awsAuthRole{"arn:aws:iam::123456789012:role/node", "system:node:{{EC2PrivateDNSName}}", []string{"system:bootstrappers", "system:nodes"}}
+
+	data, err := renderAwsAuthRoles([]awsAuthRole{nodeRole}, []RoleMapping{
+		{RoleArn: "arn:aws:iam::123456789012:role/admin", Username: "admin", Groups: []string{"system:masters"}},
+		{RoleArn: "arn:aws:iam::123456789012:role/viewer", Username: "viewer"},
+	})
+	assert.NoError(t, err)
+
+	var roles []awsAuthRole
+	assert.NoError(t, json.Unmarshal([]byte(data), &roles))
+	assert.Equal(t, 3, len(roles))
+	assert.Equal(t, nodeRole, roles[0], "The node role should always be mapped first")
+	assert.Equal(t, []string{}, roles[2].Groups, "Groups should never be null")
+
+	// Remapping the node role from config would lock the nodes out
+	_, err = renderAwsAuthRoles([]awsAuthRole{nodeRole}, []RoleMapping{
+		{RoleArn: nodeRole.RoleArn, Username: "oops"},
+	})
+	assert.Error(t, err)
+}
+
+func TestAccessEntries(t *testing.T) {
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		cluster, err := eks.NewCluster(ctx, "eks-cluster", &eks.ClusterArgs{
+			Name:      pulumi.String("test"),
+			RoleArn:   pulumi.String("arn:aws:iam::123456789012:role/cluster"),
+			VpcConfig: &eks.ClusterVpcConfigArgs{SubnetIds: pulumi.StringArray{}},
+		})
+		assert.NoError(t, err)
+		nodeRole, err := iam.NewRole(ctx, "node", &iam.RoleArgs{AssumeRolePolicy: pulumi.String("{}")})
+		assert.NoError(t, err)
+		deps, err := setupAccessEntries(ctx, cluster, &eksConfig{
+			Addons: addonsConfig("karpenter"),
+			Access: Access{
+				AuthenticationMode: "API",
+				Entries: []AccessEntry{
+					{PrincipalArn: "arn:aws:iam::123456789012:role/admins", Policy: "clusterAdmin"},
+					{PrincipalArn: "arn:aws:iam::123456789012:role/team", Policy: "edit", Username: "team", Namespaces: []string{"apps"}},
+				},
+			},
+		}, nodeRole)
+		assert.Equal(t, 1, len(deps), "Nodes should wait for the node role entry only")
+		return err
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	node := m.inputs["access-karpenter-node"]
+	assert.Equal(t, "EC2_LINUX", node["type"].StringValue(), "Karpenter nodes need an entry for the node role")
+	assert.Equal(t, "arn:aws:iam::123456789012:role/node", node["principalArn"].StringValue())
+
+	entry := m.inputs["access-role-admins"]
+	assert.Equal(t, "test", entry["clusterName"].StringValue())
+	assert.Equal(t, "STANDARD", entry["type"].StringValue())
+	assert.False(t, entry.HasValue("userName"), "Unset optional args should not be sent")
+
+	scope := m.inputs["access-role-admins-clusterAdmin"]["accessScope"].ObjectValue()
+	assert.Equal(t, "cluster", scope["type"].StringValue())
+	assert.False(t, scope.HasValue("namespaces"))
+
+	team := m.inputs["access-role-team-edit"]
+	assert.Equal(t, accessPolicies["edit"], team["policyArn"].StringValue())
+	assert.Equal(t, "arn:aws:iam::123456789012:role/team", team["principalArn"].StringValue())
+	scope = team["accessScope"].ObjectValue()
+	assert.Equal(t, "namespace", scope["type"].StringValue())
+	assert.Equal(t, "apps", scope["namespaces"].ArrayValue()[0].StringValue())
+	assert.Equal(t, "team", m.inputs["access-role-team"]["userName"].StringValue())
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	corev1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/core/v1"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"gopkg.in/yaml.v2"
+)
+
+// What addons get to deploy themselves
+type addonEnv struct {
+	eksResources *eksResources
+	eksConfig    *eksConfig
+	cluster      *clusterIdentity
+	// Node affinity and tolerations every addon shares, see addonAffinity
+	affinity    pulumi.Map
+	tolerations pulumi.Array
+}
+
+// A Helm addon picked by name in eks.addons
+type Addon interface {
+	Name() string
+	// Addons deployed before this one when they are enabled too
+	After() []string
+	// Whether eks.addonIdentity can pick how its service account gets AWS credentials
+	UsesAwsIdentity() bool
+	// Checks the addon's settings before anything is created
+	Validate(eksConfig *eksConfig) error
+	// The chart installed when eks.addons doesn't override it
+	Chart(eksConfig *eksConfig) addonChart
+	// Installs the chart resolved from the addon settings, returns the resource later addons wait for
+	Deploy(ctx *pulumi.Context, env *addonEnv, chart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error)
+}
+
+var addonRegistry = newAddonRegistry(metricsServerAddon{}, loadBalancerControllerAddon{}, clusterAutoscalerAddon{}, karpenterAddon{})
+
+func newAddonRegistry(addons ...Addon) map[string]Addon {
+	registry := map[string]Addon{}
+	for _, a := range addons {
+		registry[a.Name()] = a
+	}
+	return registry
+}
+
+func addonNames() []string {
+	names := make([]string, 0, len(addonRegistry))
+	for name := range addonRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Accepts the map of addon settings as well as the older list of addon names
+func (a *AddonsConfig) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err == nil {
+		*a = AddonsConfig{}
+		for _, name := range names {
+			(*a)[name] = AddonSettings{}
+		}
+		return nil
+	}
+	var settings map[string]AddonSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	*a = settings
+	return nil
+}
+
+func addonEnabled(eksConfig *eksConfig, name string) bool {
+	settings, ok := eksConfig.Addons[name]
+	return ok && orTrue(settings.Enabled)
+}
+
+// How addon charts are installed. helm.Chart renders the chart and manages every object as its own resource, so
+// previews show per-object diffs, but Helm hooks don't run and CRDs are never upgraded. A Helm release is installed
+// by Helm itself and shows up in `helm list`.
+const (
+	installChart   = "chart"
+	installRelease = "release"
+)
+
+var addonInstallModes = []string{installChart, installRelease}
+
+// Whether an enabled addon is installed as a Helm release, which needs eksResources.helmProvider
+func helmReleasesEnabled(eksConfig *eksConfig) bool {
+	for name, settings := range eksConfig.Addons {
+		if addonEnabled(eksConfig, name) && settings.Install == installRelease {
+			return true
+		}
+	}
+	return false
+}
+
+// Where an addon's chart comes from and the values layered over the ones the addon computes
+type addonChart struct {
+	Chart     string
+	Version   string
+	Namespace string
+	// Empty for OCI charts, the registry is part of Chart
+	Repo      string
+	Install   string
+	release   AddonRelease
+	overrides map[string]interface{}
+}
+
+// The addon's default chart with the eks.addons settings applied. Values files are merged in order, then values,
+// each one deep-merged over the previous so a setting only replaces the keys it names.
+func resolveAddonChart(a Addon, eksConfig *eksConfig) (*addonChart, error) {
+	settings := eksConfig.Addons[a.Name()]
+	chart := a.Chart(eksConfig)
+	if settings.Version != "" {
+		chart.Version = settings.Version
+	}
+	if settings.Namespace != "" {
+		chart.Namespace = settings.Namespace
+	}
+	if settings.Repo != "" {
+		chart.Repo = settings.Repo
+	}
+	chart.Install = settings.Install
+	if chart.Install == "" {
+		chart.Install = installChart
+	}
+	if !contains(addonInstallModes, chart.Install) {
+		return nil, fmt.Errorf("install must be one of %v, got %q", addonInstallModes, chart.Install)
+	}
+	if settings.Release.Timeout < 0 {
+		return nil, fmt.Errorf("release.timeout must be a number of seconds, got %d", settings.Release.Timeout)
+	}
+	chart.release = settings.Release
+
+	chart.overrides = map[string]interface{}{}
+	for _, file := range settings.ValuesFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var values map[interface{}]interface{}
+		if err = yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		mergeValues(chart.overrides, plainValues(values).(map[string]interface{}))
+	}
+	mergeValues(chart.overrides, settings.Values)
+	return &chart, nil
+}
+
+// yaml.v2 decodes mappings with interface{} keys, Helm values are keyed by strings
+func plainValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		res := map[string]interface{}{}
+		for k, item := range v {
+			res[fmt.Sprint(k)] = plainValues(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = plainValues(item)
+		}
+		return res
+	}
+	return v
+}
+
+// Deep-merges src into dst, lists and everything else that isn't a map is replaced
+func mergeValues(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		if m, ok := v.(map[string]interface{}); ok {
+			if d, ok := dst[k].(map[string]interface{}); ok {
+				mergeValues(d, m)
+			} else {
+				dst[k] = mergeValues(map[string]interface{}{}, m)
+			}
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// The addon's values with the overrides deep-merged over them
+func (c *addonChart) values(values pulumi.Map) pulumi.Map {
+	return overlayValues(values, c.overrides)
+}
+
+func overlayValues(values pulumi.Map, overrides map[string]interface{}) pulumi.Map {
+	res := pulumi.Map{}
+	for k, v := range values {
+		res[k] = v
+	}
+	for k, v := range overrides {
+		if o, ok := v.(map[string]interface{}); ok {
+			if m, ok := res[k].(pulumi.Map); ok {
+				res[k] = overlayValues(m, o)
+				continue
+			}
+		}
+		res[k] = pulumi.ToOutput(v)
+	}
+	return res
+}
+
+func (c *addonChart) chartArgs(values pulumi.Map) helm.ChartArgs {
+	args := helm.ChartArgs{
+		Chart:     pulumi.String(c.Chart),
+		Version:   pulumi.String(c.Version),
+		Namespace: pulumi.String(c.Namespace),
+		Values:    c.values(values),
+	}
+	if c.Repo != "" {
+		args.FetchArgs = helm.FetchArgs{Repo: pulumi.String(c.Repo)}
+	}
+	return args
+}
+
+func (c *addonChart) releaseArgs(name string, values pulumi.Map) *helmReleaseArgs {
+	timeout := c.release.Timeout
+	if timeout == 0 {
+		timeout = 300
+	}
+	args := &helmReleaseArgs{
+		Name:            pulumi.String(name),
+		Chart:           pulumi.String(c.Chart),
+		Version:         pulumi.String(c.Version),
+		Namespace:       pulumi.String(c.Namespace),
+		Values:          c.values(values),
+		Atomic:          pulumi.Bool(orTrue(c.release.Atomic)),
+		SkipAwait:       pulumi.Bool(!orTrue(c.release.Wait)),
+		CreateNamespace: pulumi.Bool(orTrue(c.release.CreateNamespace)),
+		CleanupOnFail:   pulumi.Bool(orTrue(c.release.CleanupOnFail)),
+		SkipCrds:        pulumi.Bool(c.release.SkipCrds),
+		Timeout:         pulumi.Int(timeout),
+	}
+	if c.Repo != "" {
+		args.RepositoryOpts = &helmReleaseRepositoryOptsArgs{Repo: pulumi.String(c.Repo)}
+	}
+	return args
+}
+
+// Installs the chart the way the addon settings ask for, name is the Helm release name with install: release
+func (c *addonChart) install(ctx *pulumi.Context, eksResources *eksResources, name string, values pulumi.Map, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	if c.Install == installRelease {
+		return newHelmRelease(ctx, name, c.releaseArgs(name, values), eksResources.helmProvider, opts...)
+	}
+	opts = append(opts, pulumi.Provider(eksResources.k8sProvider))
+	ns, err := c.chartNamespace(ctx, eksResources, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if ns != nil {
+		opts = append(opts, pulumi.DependsOn([]pulumi.Resource{ns}))
+	}
+	return helm.NewChart(ctx, name, c.chartArgs(values), opts...)
+}
+
+// helm.Chart only renders objects into the namespace, unlike a release it never creates it. Namespaces the
+// cluster comes with are left alone, and addons sharing one get the same resource.
+func (c *addonChart) chartNamespace(ctx *pulumi.Context, eksResources *eksResources, opts ...pulumi.ResourceOption) (*corev1.Namespace, error) {
+	if c.Namespace == "" || c.Namespace == "kube-system" || c.Namespace == "default" {
+		return nil, nil
+	}
+	if ns, ok := eksResources.namespaces[c.Namespace]; ok {
+		return ns, nil
+	}
+	ns, err := corev1.NewNamespace(ctx, "namespace-"+c.Namespace, &corev1.NamespaceArgs{
+		Metadata: &metav1.ObjectMetaArgs{Name: pulumi.String(c.Namespace)},
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if eksResources.namespaces == nil {
+		eksResources.namespaces = map[string]*corev1.Namespace{}
+	}
+	eksResources.namespaces[c.Namespace] = ns
+	return ns, nil
+}
+
+// Resolves the enabled addons in deployment order, an addon comes after every enabled addon of its After list.
+// Unknown names are an error rather than a silently missing addon.
+func enabledAddons(eksConfig *eksConfig) ([]Addon, error) {
+	enabled := map[string]Addon{}
+	configured := make([]string, 0, len(eksConfig.Addons))
+	for name := range eksConfig.Addons {
+		configured = append(configured, name)
+	}
+	sort.Strings(configured)
+	for _, name := range configured {
+		a, ok := addonRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown addon %q, valid addons are %s", name, strings.Join(addonNames(), ", "))
+		}
+		if addonEnabled(eksConfig, name) {
+			enabled[name] = a
+		}
+	}
+	for name := range eksConfig.AddonIdentity {
+		a, ok := addonRegistry[name]
+		if !ok || !a.UsesAwsIdentity() {
+			var valid []string
+			for _, n := range addonNames() {
+				if addonRegistry[n].UsesAwsIdentity() {
+					valid = append(valid, n)
+				}
+			}
+			return nil, fmt.Errorf("addonIdentity: %q has no AWS identity, valid addons are %s", name, strings.Join(valid, ", "))
+		}
+	}
+
+	names := make([]string, 0, len(enabled))
+	for name := range enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ordered []Addon
+	state := map[string]int{} // 1 while visiting, 2 once ordered
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("addons depend on each other in a cycle: %s", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		after := append([]string{}, enabled[name].After()...)
+		sort.Strings(after)
+		for _, dep := range after {
+			if _, ok := enabled[dep]; ok {
+				if err := visit(dep, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = 2
+		ordered = append(ordered, enabled[name])
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range ordered {
+		if err := a.Validate(eksConfig); err != nil {
+			return nil, fmt.Errorf("addon %s: %w", a.Name(), err)
+		}
+		if _, err := resolveAddonChart(a, eksConfig); err != nil {
+			return nil, fmt.Errorf("addon %s: %w", a.Name(), err)
+		}
+	}
+	return ordered, nil
+}
+
+// Deploys the enabled addons in order, each one waits for the addons it comes after
+func setupAddons(ctx *pulumi.Context, env *addonEnv) error {
+	addons, err := enabledAddons(env.eksConfig)
+	if err != nil {
+		return err
+	}
+	deployed := map[string]pulumi.Resource{}
+	for _, a := range addons {
+		deps := []pulumi.Resource{}
+		for _, dep := range a.After() {
+			if r, ok := deployed[dep]; ok && r != nil {
+				deps = append(deps, r)
+			}
+		}
+		chart, err := resolveAddonChart(a, env.eksConfig)
+		if err != nil {
+			return err
+		}
+		r, err := a.Deploy(ctx, env, chart, pulumi.DependsOn(deps))
+		if err != nil {
+			return err
+		}
+		deployed[a.Name()] = r
+	}
+	return nil
+}
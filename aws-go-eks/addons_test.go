@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAddon struct {
+	name  string
+	after []string
+}
+
+func (a fakeAddon) Name() string                        { return a.name }
+func (a fakeAddon) After() []string                     { return a.after }
+func (a fakeAddon) UsesAwsIdentity() bool               { return false }
+func (a fakeAddon) Validate(eksConfig *eksConfig) error { return nil }
+
+func (a fakeAddon) Chart(eksConfig *eksConfig) addonChart { return addonChart{Chart: a.name} }
+
+func (a fakeAddon) Deploy(ctx *pulumi.Context, env *addonEnv, chart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	return nil, nil
+}
+
+func addonsConfig(names ...string) AddonsConfig {
+	addons := AddonsConfig{}
+	for _, name := range names {
+		addons[name] = AddonSettings{}
+	}
+	return addons
+}
+
+func addonOrder(addons []Addon) []string {
+	var names []string
+	for _, a := range addons {
+		names = append(names, a.Name())
+	}
+	return names
+}
+
+func TestEnabledAddons(t *testing.T) {
+	addons, err := enabledAddons(&eksConfig{Addons: addonsConfig("metricsServer", "clusterAutoscaller", "loadBalancerController")})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"loadBalancerController", "clusterAutoscaller", "metricsServer"}, addonOrder(addons),
+		"The load balancer controller should come before the addons creating Services")
+
+	_, err = enabledAddons(&eksConfig{Addons: addonsConfig("metricServer")})
+	assert.EqualError(t, err, `unknown addon "metricServer", valid addons are clusterAutoscaller, karpenter, loadBalancerController, metricsServer`)
+
+	_, err = enabledAddons(&eksConfig{AddonIdentity: map[string]string{"metricsServer": identityPodIdentity}})
+	assert.Error(t, err, "metrics-server has no AWS identity to pick")
+
+	_, err = enabledAddons(&eksConfig{Addons: addonsConfig("karpenter", "clusterAutoscaller")})
+	assert.Error(t, err)
+
+	disabled := false
+	addons, err = enabledAddons(&eksConfig{Addons: AddonsConfig{"karpenter": {}, "clusterAutoscaller": {Enabled: &disabled}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"karpenter"}, addonOrder(addons))
+
+	registry := addonRegistry
+	defer func() { addonRegistry = registry }()
+	addonRegistry = newAddonRegistry(fakeAddon{"a", []string{"c"}}, fakeAddon{"b", []string{"a"}}, fakeAddon{"c", nil})
+	addons, err = enabledAddons(&eksConfig{Addons: addonsConfig("a", "b", "c")})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c", "a", "b"}, addonOrder(addons))
+
+	addonRegistry = newAddonRegistry(fakeAddon{"a", []string{"b"}}, fakeAddon{"b", []string{"a"}})
+	_, err = enabledAddons(&eksConfig{Addons: addonsConfig("a", "b")})
+	assert.EqualError(t, err, "addons depend on each other in a cycle: a -> b -> a")
+}
+
+func TestAddonsConfig(t *testing.T) {
+	var addons AddonsConfig
+	assert.NoError(t, json.Unmarshal([]byte(`["metricsServer"]`), &addons))
+	assert.Equal(t, addonsConfig("metricsServer"), addons, "The list of names is still accepted")
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"metricsServer": {"version": "3.12.1", "values": {"replicas": 2}}}`), &addons))
+	assert.Equal(t, "3.12.1", addons["metricsServer"].Version)
+	assert.Equal(t, map[string]interface{}{"replicas": 2.0}, addons["metricsServer"].Values)
+}
+
+func TestAddonChart(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "values.yaml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("args:\n  - --kubelet-insecure-tls\nresources:\n  requests:\n    cpu: 100m\n    memory: 200Mi\n"), 0600))
+
+	config := &eksConfig{Addons: AddonsConfig{"metricsServer": {
+		Version:     "3.12.1",
+		Namespace:   "monitoring",
+		ValuesFiles: []string{file},
+		Values: map[string]interface{}{
+			"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "50m"}},
+		},
+	}}}
+	chart, err := resolveAddonChart(metricsServerAddon{}, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.12.1", chart.Version)
+	assert.Equal(t, "monitoring", chart.Namespace)
+	assert.Equal(t, "https://kubernetes-sigs.github.io/metrics-server/", chart.Repo, "Unset fields keep the defaults")
+	assert.Equal(t, map[string]interface{}{
+		"args":      []interface{}{"--kubelet-insecure-tls"},
+		"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "50m", "memory": "200Mi"}},
+	}, chart.overrides, "Values win over values files and only replace the keys they name")
+
+	// Overrides merge into the computed values rather than replacing whole maps
+	affinity := pulumi.Map{"nodeAffinity": pulumi.String("computed")}
+	values := chart.values(pulumi.Map{"affinity": affinity, "resources": pulumi.Map{"limits": pulumi.String("kept")}})
+	assert.Equal(t, affinity, values["affinity"])
+	assert.Contains(t, values["resources"], "limits")
+	assert.Contains(t, values["resources"], "requests")
+
+	config.Addons["metricsServer"] = AddonSettings{ValuesFiles: []string{filepath.Join(dir, "missing.yaml")}}
+	_, err = enabledAddons(config)
+	assert.Error(t, err, "Missing values files fail before anything is created")
+}
+
+func TestAddonRelease(t *testing.T) {
+	_, err := resolveAddonChart(metricsServerAddon{}, &eksConfig{Addons: AddonsConfig{"metricsServer": {Install: "helm"}}})
+	assert.Error(t, err)
+
+	wait := false
+	config := &eksConfig{Addons: AddonsConfig{
+		"metricsServer":          {Install: installRelease, Release: AddonRelease{Wait: &wait, SkipCrds: true}},
+		"loadBalancerController": {},
+	}}
+	assert.True(t, helmReleasesEnabled(config))
+	chart, err := resolveAddonChart(metricsServerAddon{}, config)
+	assert.NoError(t, err)
+
+	m := &recordingMocks{}
+	err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+		provider, err := newK8sNextProvider(ctx, "k8s-helm", &k8sNextProviderArgs{Kubeconfig: pulumi.String("{}")})
+		assert.NoError(t, err)
+		r, err := chart.install(ctx, &eksResources{helmProvider: provider}, "metrics-server", pulumi.Map{"replicas": pulumi.Int(2)})
+		assert.NoError(t, err)
+		assert.IsType(t, &helmRelease{}, r)
+
+		// OCI charts carry the registry in the chart reference
+		oci := *chart
+		oci.Repo = ""
+		_, err = oci.install(ctx, &eksResources{helmProvider: provider}, "oci", pulumi.Map{})
+		assert.NoError(t, err)
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	release := m.inputs["metrics-server"]
+	assert.Equal(t, "metrics-server", release["name"].StringValue())
+	assert.Equal(t, chart.Chart, release["chart"].StringValue())
+	assert.Equal(t, chart.Version, release["version"].StringValue())
+	assert.Equal(t, "kube-system", release["namespace"].StringValue())
+	assert.True(t, release["atomic"].BoolValue())
+	assert.True(t, release["skipAwait"].BoolValue(), "wait: false should skip waiting")
+	assert.True(t, release["skipCrds"].BoolValue())
+	assert.True(t, release["cleanupOnFail"].BoolValue())
+	assert.True(t, release["createNamespace"].BoolValue())
+	assert.Equal(t, float64(300), release["timeout"].NumberValue())
+	assert.Equal(t, float64(2), release["values"].ObjectValue()["replicas"].NumberValue())
+	assert.Equal(t, "https://kubernetes-sigs.github.io/metrics-server/", release["repositoryOpts"].ObjectValue()["repo"].StringValue())
+	assert.False(t, m.inputs["oci"].HasValue("repositoryOpts"), "OCI charts have no repository")
+
+	config.Addons["metricsServer"] = AddonSettings{}
+	assert.False(t, helmReleasesEnabled(config), "Charts need no second provider")
+}
+
+func TestAddonChartNamespace(t *testing.T) {
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		eksResources := &eksResources{}
+		ns, err := (&addonChart{Namespace: "kube-system"}).chartNamespace(ctx, eksResources)
+		assert.NoError(t, err)
+		assert.Nil(t, ns, "The cluster comes with kube-system")
+
+		ns, err = (&addonChart{Namespace: "monitoring"}).chartNamespace(ctx, eksResources)
+		assert.NoError(t, err)
+		assert.NotNil(t, ns)
+		shared, err := (&addonChart{Namespace: "monitoring"}).chartNamespace(ctx, eksResources)
+		assert.NoError(t, err)
+		assert.Same(t, ns, shared, "Addons sharing a namespace should not create it twice")
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "monitoring", m.inputs["namespace-monitoring"]["metadata"].ObjectValue()["name"].StringValue())
+	assert.NotContains(t, m.inputs, "namespace-kube-system")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ssm"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Public SSM parameters holding the recommended release of the EKS optimized AMIs, by AMI type.
+// The %s is the Kubernetes version of the cluster.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/retrieve-ami-id.html
+var amiReleaseParameters = map[string]string{
+	"AL2_x86_64":                 "/aws/service/eks/optimized-ami/%s/amazon-linux-2/recommended/release_version",
+	"AL2_x86_64_GPU":             "/aws/service/eks/optimized-ami/%s/amazon-linux-2-gpu/recommended/release_version",
+	"AL2_ARM_64":                 "/aws/service/eks/optimized-ami/%s/amazon-linux-2-arm64/recommended/release_version",
+	"AL2023_x86_64_STANDARD":     "/aws/service/eks/optimized-ami/%s/amazon-linux-2023/x86_64/standard/recommended/release_version",
+	"AL2023_x86_64_NVIDIA":       "/aws/service/eks/optimized-ami/%s/amazon-linux-2023/x86_64/nvidia/recommended/release_version",
+	"AL2023_x86_64_NEURON":       "/aws/service/eks/optimized-ami/%s/amazon-linux-2023/x86_64/neuron/recommended/release_version",
+	"AL2023_ARM_64_STANDARD":     "/aws/service/eks/optimized-ami/%s/amazon-linux-2023/arm64/standard/recommended/release_version",
+	"BOTTLEROCKET_x86_64":        "/aws/service/bottlerocket/aws-k8s-%s/x86_64/latest/image_version",
+	"BOTTLEROCKET_ARM_64":        "/aws/service/bottlerocket/aws-k8s-%s/arm64/latest/image_version",
+	"BOTTLEROCKET_x86_64_NVIDIA": "/aws/service/bottlerocket/aws-k8s-%s-nvidia/x86_64/latest/image_version",
+	"BOTTLEROCKET_ARM_64_NVIDIA": "/aws/service/bottlerocket/aws-k8s-%s-nvidia/arm64/latest/image_version",
+}
+
+// Groups without a release version of their own follow the cluster wide one, custom images have no release
+func withReleaseVersion(nodeGroups []NodeGroup, releaseVersion string) []NodeGroup {
+	res := append([]NodeGroup{}, nodeGroups...)
+	for i := range res {
+		customImage := res[i].LaunchTemplate != nil && res[i].LaunchTemplate.ImageId != ""
+		if res[i].ReleaseVersion == "" && !customImage {
+			res[i].ReleaseVersion = releaseVersion
+		}
+	}
+	return res
+}
+
+// AMI release of a node group: pinned, or "latest" for the recommended release of the cluster version,
+// which rolls the nodes on the first update after AWS publishes a new one
+func nodeGroupReleaseVersion(ctx *pulumi.Context, ng *NodeGroup, eksCluster *eks.Cluster) (pulumi.StringPtrInput, error) {
+	if ng.ReleaseVersion == "" {
+		return nil, nil
+	}
+	if ng.LaunchTemplate != nil && ng.LaunchTemplate.ImageId != "" {
+		return nil, fmt.Errorf("node group %s: releaseVersion can't be used with a custom imageId", ng.Name)
+	}
+	if ng.ReleaseVersion != "latest" {
+		return pulumi.String(ng.ReleaseVersion), nil
+	}
+
+	amiType := ng.AmiType
+	if amiType == "" {
+		amiType = defaultAmiType
+	}
+	parameter, ok := amiReleaseParameters[amiType]
+	if !ok {
+		return nil, fmt.Errorf("node group %s: no published release for amiType %s", ng.Name, amiType)
+	}
+	return ssm.LookupParameterOutput(ctx, ssm.LookupParameterOutputArgs{
+		Name: pulumi.Sprintf(parameter, eksCluster.Version),
+	}).Value(), nil
+}
+
+// Rolling update settings, either a number of nodes or a percentage of the group may be down at once
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/managed-node-update-behavior.html
+func nodeGroupUpdateConfig(ng *NodeGroup) (eks.NodeGroupUpdateConfigPtrInput, error) {
+	u := ng.UpdateConfig
+	if u == nil {
+		return nil, nil
+	}
+	switch {
+	case u.MaxUnavailable > 0 && u.MaxUnavailablePercentage > 0:
+		return nil, fmt.Errorf("node group %s: set either maxUnavailable or maxUnavailablePercentage, not both", ng.Name)
+	case u.MaxUnavailable > 0:
+		if u.MaxUnavailable > 100 {
+			return nil, fmt.Errorf("node group %s: maxUnavailable can't be more than 100", ng.Name)
+		}
+		return &eks.NodeGroupUpdateConfigArgs{MaxUnavailable: pulumi.Int(u.MaxUnavailable)}, nil
+	case u.MaxUnavailablePercentage > 0:
+		if u.MaxUnavailablePercentage > 100 {
+			return nil, fmt.Errorf("node group %s: maxUnavailablePercentage can't be more than 100", ng.Name)
+		}
+		return &eks.NodeGroupUpdateConfigArgs{MaxUnavailablePercentage: pulumi.Int(u.MaxUnavailablePercentage)}, nil
+	}
+	return nil, fmt.Errorf("node group %s: updateConfig needs maxUnavailable or maxUnavailablePercentage", ng.Name)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeGroupReleaseVersion(t *testing.T) {
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		cluster, err := eks.NewCluster(ctx, "eks-cluster", &eks.ClusterArgs{
+			RoleArn:   pulumi.String("arn:aws:iam::123456789012:role/cluster"),
+			Version:   pulumi.String("1.30"),
+			VpcConfig: &eks.ClusterVpcConfigArgs{SubnetIds: pulumi.StringArray{}},
+		})
+		assert.NoError(t, err)
+
+		version, err := nodeGroupReleaseVersion(ctx, &NodeGroup{Name: "arm", AmiType: "AL2023_ARM_64_STANDARD", ReleaseVersion: "latest"}, cluster)
+		assert.NoError(t, err)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		version.ToStringPtrOutput().ApplyT(func(v *string) error {
+			assert.Equal(t, "1.30.4-20240917", *v)
+			wg.Done()
+			return nil
+		})
+		wg.Wait()
+
+		version, err = nodeGroupReleaseVersion(ctx, &NodeGroup{Name: "pinned", ReleaseVersion: "1.29.3-20240531"}, cluster)
+		assert.NoError(t, err)
+		assert.Equal(t, pulumi.String("1.29.3-20240531"), version)
+
+		_, err = nodeGroupReleaseVersion(ctx, &NodeGroup{Name: "custom", ReleaseVersion: "latest", LaunchTemplate: &LaunchTemplate{ImageId: "ami-123"}}, cluster)
+		assert.Error(t, err, "Custom images have no release")
+		_, err = nodeGroupReleaseVersion(ctx, &NodeGroup{Name: "windows", AmiType: "WINDOWS_CORE_2022_x86_64", ReleaseVersion: "latest"}, cluster)
+		assert.Error(t, err)
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	lookups := m.calls["aws:ssm/getParameter:getParameter"]
+	assert.Len(t, lookups, 1)
+	assert.Equal(t, "/aws/service/eks/optimized-ami/1.30/amazon-linux-2023/arm64/standard/recommended/release_version",
+		lookups[0]["name"].StringValue())
+
+	groups := withReleaseVersion([]NodeGroup{
+		{Name: "default"},
+		{Name: "pinned", ReleaseVersion: "1.29.3-20240531"},
+		{Name: "custom", LaunchTemplate: &LaunchTemplate{ImageId: "ami-123"}},
+	}, "latest")
+	assert.Equal(t, "latest", groups[0].ReleaseVersion)
+	assert.Equal(t, "1.29.3-20240531", groups[1].ReleaseVersion)
+	assert.Equal(t, "", groups[2].ReleaseVersion)
+}
+
+func TestNodeGroupUpdateConfig(t *testing.T) {
+	config, err := nodeGroupUpdateConfig(&NodeGroup{Name: "default"})
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	config, err = nodeGroupUpdateConfig(&NodeGroup{Name: "default", UpdateConfig: &UpdateConfig{MaxUnavailablePercentage: 33}})
+	assert.NoError(t, err)
+	assert.Equal(t, &eks.NodeGroupUpdateConfigArgs{MaxUnavailablePercentage: pulumi.Int(33)}, config)
+
+	for _, u := range []UpdateConfig{
+		{MaxUnavailable: 1, MaxUnavailablePercentage: 10},
+		{MaxUnavailable: 101},
+		{MaxUnavailablePercentage: 101},
+		{},
+	} {
+		u := u
+		_, err = nodeGroupUpdateConfig(&NodeGroup{Name: "default", UpdateConfig: &u})
+		assert.Error(t, err, "%+v", u)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// CPU architecture of every AMI type a managed node group accepts, spelled the way kubernetes.io/arch labels it
+// Docs: https://docs.aws.amazon.com/eks/latest/APIReference/API_Nodegroup.html#AmazonEKS-Type-Nodegroup-amiType
+var amiTypeArchitectures = map[string]string{
+	"AL2_x86_64":                 "amd64",
+	"AL2_x86_64_GPU":             "amd64",
+	"AL2_ARM_64":                 "arm64",
+	"BOTTLEROCKET_x86_64":        "amd64",
+	"BOTTLEROCKET_x86_64_NVIDIA": "amd64",
+	"BOTTLEROCKET_ARM_64":        "arm64",
+	"BOTTLEROCKET_ARM_64_NVIDIA": "arm64",
+	"AL2023_x86_64_STANDARD":     "amd64",
+	"AL2023_x86_64_NVIDIA":       "amd64",
+	"AL2023_x86_64_NEURON":       "amd64",
+	"AL2023_ARM_64_STANDARD":     "arm64",
+}
+
+// EKS picks AL2 on x86 when a node group has no AMI type and no custom image
+const defaultAmiType = "AL2_x86_64"
+
+// Graviton families carry a g right after the generation: t4g, m7gd, c6gn, im4gn, and the original a1
+var gravitonFamily = regexp.MustCompile(`^(a1|[a-z]+[0-9]+g[a-z0-9-]*)$`)
+
+func instanceArchitecture(instanceType string) string {
+	family := strings.SplitN(instanceType, ".", 2)[0]
+	if gravitonFamily.MatchString(family) {
+		return "arm64"
+	}
+	return "amd64"
+}
+
+// Architecture a node group runs on, every instance type has to agree with its AMI type.
+// A custom image has no AMI type, the instance types decide on their own then.
+func nodeGroupArchitecture(ng *NodeGroup) (string, error) {
+	customImage := ng.LaunchTemplate != nil && ng.LaunchTemplate.ImageId != ""
+	amiType := ng.AmiType
+	if amiType == "" {
+		amiType = defaultAmiType
+	}
+	arch, ok := amiTypeArchitectures[amiType]
+	if !ok {
+		return "", fmt.Errorf("node group %s: unknown amiType %q", ng.Name, ng.AmiType)
+	}
+	if customImage && len(ng.InstanceTypes) > 0 {
+		arch = instanceArchitecture(ng.InstanceTypes[0])
+	}
+	for _, t := range ng.InstanceTypes {
+		if instanceArchitecture(t) != arch {
+			if customImage {
+				return "", fmt.Errorf("node group %s: instance types %v mix architectures", ng.Name, ng.InstanceTypes)
+			}
+			return "", fmt.Errorf("node group %s: instance type %s is %s but amiType %s runs on %s", ng.Name, t, instanceArchitecture(t), amiType, arch)
+		}
+	}
+	return arch, nil
+}
+
+// Every architecture addons may get scheduled on, sorted so the chart values stay stable between runs
+func clusterArchitectures(eksConfig *eksConfig) ([]string, error) {
+	seen := map[string]bool{}
+	for i := range eksConfig.NodeGroups {
+		arch, err := nodeGroupArchitecture(&eksConfig.NodeGroups[i])
+		if err != nil {
+			return nil, err
+		}
+		seen[arch] = true
+	}
+	if karpenterEnabled(eksConfig) {
+		for _, pool := range eksConfig.Karpenter.NodePools {
+			// Karpenter only launches amd64 nodes unless a pool asks for more
+			if len(pool.Architectures) == 0 {
+				seen["amd64"] = true
+			}
+			for _, a := range pool.Architectures {
+				seen[a] = true
+			}
+		}
+	}
+	archs := []string{}
+	for a := range seen {
+		archs = append(archs, a)
+	}
+	sort.Strings(archs)
+	return archs, nil
+}
+
+// Helm affinity values keeping a pod on the given architectures. The addon images are all multi-arch,
+// the affinity is what guarantees a pod never lands on a node its image has no build for.
+// Charts replace lists instead of merging them, so any default match expressions have to be passed again.
+// Without architectures (Fargate only, or Karpenter without node pools) there is nothing to match, an empty
+// In would keep the pod off every node, and without any expression the chart keeps its own affinity.
+func archAffinity(archs []string, extra ...pulumi.Map) pulumi.Map {
+	expressions := pulumi.Array{}
+	if len(archs) > 0 {
+		expressions = append(expressions, pulumi.Map{
+			"key":      pulumi.String("kubernetes.io/arch"),
+			"operator": pulumi.String("In"),
+			"values":   toPulumiStringArray(archs),
+		})
+	}
+	for _, e := range extra {
+		expressions = append(expressions, e)
+	}
+	if len(expressions) == 0 {
+		return pulumi.Map{}
+	}
+	return pulumi.Map{
+		"nodeAffinity": pulumi.Map{
+			"requiredDuringSchedulingIgnoredDuringExecution": pulumi.Map{
+				"nodeSelectorTerms": pulumi.Array{
+					pulumi.Map{"matchExpressions": expressions},
+				},
+			},
+		},
+	}
+}
+
+// Where the Helm addons may run: a supported architecture, and the system node groups when there are any
+func addonAffinity(eksConfig *eksConfig, extra ...pulumi.Map) (pulumi.Map, error) {
+	archs, err := clusterArchitectures(eksConfig)
+	if err != nil {
+		return nil, err
+	}
+	if hasSystemNodeGroup(eksConfig.NodeGroups) {
+		extra = append(extra, pulumi.Map{
+			"key":      pulumi.String(systemNodeLabel),
+			"operator": pulumi.String("In"),
+			"values":   pulumi.StringArray{pulumi.String(systemNodeValue)},
+		})
+	}
+	return archAffinity(archs, extra...), nil
+}
+
+// Lets the addons onto the tainted system node groups
+func addonTolerations() pulumi.Array {
+	return pulumi.Array{
+		pulumi.Map{
+			"key":      pulumi.String(systemTaintKey),
+			"operator": pulumi.String("Exists"),
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeGroupArchitecture(t *testing.T) {
+	assert.Equal(t, "arm64", instanceArchitecture("m7gd.large"))
+	assert.Equal(t, "arm64", instanceArchitecture("a1.medium"))
+	assert.Equal(t, "amd64", instanceArchitecture("g5.xlarge"))
+	assert.Equal(t, "amd64", instanceArchitecture("t3.medium"))
+
+	arch, err := nodeGroupArchitecture(&NodeGroup{Name: "arm", AmiType: "BOTTLEROCKET_ARM_64", InstanceTypes: []string{"t4g.medium", "c6gn.large"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "arm64", arch)
+
+	// No AMI type means AL2 on x86
+	_, err = nodeGroupArchitecture(&NodeGroup{Name: "default", InstanceTypes: []string{"t4g.medium"}})
+	assert.Error(t, err)
+
+	// A custom image takes the architecture of its instance types, as long as they agree
+	custom := NodeGroup{Name: "custom", InstanceTypes: []string{"m6g.large"}, LaunchTemplate: &LaunchTemplate{ImageId: "ami-123"}}
+	arch, err = nodeGroupArchitecture(&custom)
+	assert.NoError(t, err)
+	assert.Equal(t, "arm64", arch)
+	custom.InstanceTypes = append(custom.InstanceTypes, "m6i.large")
+	_, err = nodeGroupArchitecture(&custom)
+	assert.Error(t, err)
+
+	archs, err := clusterArchitectures(&eksConfig{NodeGroups: []NodeGroup{
+		{Name: "x86", InstanceTypes: []string{"t3.medium"}},
+		{Name: "arm", AmiType: "AL2023_ARM_64_STANDARD", InstanceTypes: []string{"t4g.medium"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amd64", "arm64"}, archs)
+}
+
+func TestArchAffinity(t *testing.T) {
+	terms := func(affinity pulumi.Map) pulumi.Array {
+		required := affinity["nodeAffinity"].(pulumi.Map)["requiredDuringSchedulingIgnoredDuringExecution"].(pulumi.Map)
+		return required["nodeSelectorTerms"].(pulumi.Array)[0].(pulumi.Map)["matchExpressions"].(pulumi.Array)
+	}
+
+	expressions := terms(archAffinity([]string{"amd64", "arm64"}))
+	assert.Equal(t, 1, len(expressions))
+	assert.Equal(t, pulumi.String("kubernetes.io/arch"), expressions[0].(pulumi.Map)["key"])
+
+	// Fargate only, nothing to pin the pods to
+	archs, err := clusterArchitectures(&eksConfig{FargateProfiles: []FargateProfile{{Name: "apps"}}})
+	assert.NoError(t, err)
+	assert.Empty(t, archs)
+	assert.Equal(t, pulumi.Map{}, archAffinity(archs), "An empty In would match no node at all")
+
+	// Other expressions are still passed without the architecture one
+	nodePool := pulumi.Map{"key": pulumi.String("karpenter.sh/nodepool"), "operator": pulumi.String("DoesNotExist")}
+	expressions = terms(archAffinity(nil, nodePool))
+	assert.Equal(t, pulumi.Array{nodePool}, expressions)
+}
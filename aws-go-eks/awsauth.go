@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ARNs this program mapped in aws-auth on the last update. Those gone from config are dropped,
+// every other mapping found in the live object was added by someone else and is kept.
+const awsAuthManagedAnnotation = "aws-go-eks/managed-arns"
+
+func newKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfig))
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// The live aws-auth, nil until EKS or this program creates it
+func readAwsAuth(ctx context.Context, client kubernetes.Interface) (*corev1.ConfigMap, error) {
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "aws-auth", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading kube-system/aws-auth: %w", err)
+	}
+	return cm, nil
+}
+
+// The mapRoles and mapUsers keys of aws-auth, JSON is valid YAML so this reads both what we and what EKS write
+func parseAwsAuth(data map[string]string) ([]awsAuthRole, []awsAuthUser, error) {
+	var roles []awsAuthRole
+	var users []awsAuthUser
+	if err := yaml.Unmarshal([]byte(data["mapRoles"]), &roles); err != nil {
+		return nil, nil, fmt.Errorf("aws-auth mapRoles: %w", err)
+	}
+	if err := yaml.Unmarshal([]byte(data["mapUsers"]), &users); err != nil {
+		return nil, nil, fmt.Errorf("aws-auth mapUsers: %w", err)
+	}
+	// Groups are never null in what we write, whatever the source left out
+	for i := range roles {
+		if roles[i].Groups == nil {
+			roles[i].Groups = []string{}
+		}
+	}
+	for i := range users {
+		if users[i].Groups == nil {
+			users[i].Groups = []string{}
+		}
+	}
+	return roles, users, nil
+}
+
+// The aws-auth to write: our mappings first, then those others added to the live object.
+// Our mapping wins when both sides map the same ARN.
+func mergeAwsAuth(live *corev1.ConfigMap, mapRoles string, mapUsers string) (*corev1.ConfigMap, error) {
+	roles, users, err := parseAwsAuth(map[string]string{"mapRoles": mapRoles, "mapUsers": mapUsers})
+	if err != nil {
+		return nil, err
+	}
+	// Empty lists rather than null when there is nothing to map
+	roles = append([]awsAuthRole{}, roles...)
+	users = append([]awsAuthUser{}, users...)
+	managed := []string{}
+	ours := map[string]bool{}
+	for _, r := range roles {
+		managed = append(managed, r.RoleArn)
+		ours[r.RoleArn] = true
+	}
+	for _, u := range users {
+		managed = append(managed, u.UserArn)
+		ours[u.UserArn] = true
+	}
+	sort.Strings(managed)
+
+	if live != nil {
+		liveRoles, liveUsers, err := parseAwsAuth(live.Data)
+		if err != nil {
+			return nil, err
+		}
+		previous := map[string]bool{}
+		if v, ok := live.Annotations[awsAuthManagedAnnotation]; ok {
+			var arns []string
+			if err := json.Unmarshal([]byte(v), &arns); err != nil {
+				return nil, fmt.Errorf("aws-auth annotation %s: %w", awsAuthManagedAnnotation, err)
+			}
+			for _, arn := range arns {
+				previous[arn] = true
+			}
+		} else if live.Labels["app.kubernetes.io/managed-by"] == "pulumi" {
+			// Written before the annotation existed, when this program owned every mapping in there
+			for _, r := range liveRoles {
+				previous[r.RoleArn] = true
+			}
+			for _, u := range liveUsers {
+				previous[u.UserArn] = true
+			}
+		}
+		for _, r := range liveRoles {
+			if !ours[r.RoleArn] && !previous[r.RoleArn] {
+				roles = append(roles, r)
+			}
+		}
+		for _, u := range liveUsers {
+			if !ours[u.UserArn] && !previous[u.UserArn] {
+				users = append(users, u)
+			}
+		}
+	}
+
+	rolesJSON, err := json.Marshal(roles)
+	if err != nil {
+		return nil, err
+	}
+	usersJSON, err := json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	managedJSON, err := json.Marshal(managed)
+	if err != nil {
+		return nil, err
+	}
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "aws-auth",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{awsAuthManagedAnnotation: string(managedJSON)},
+		},
+		Data: map[string]string{
+			"mapRoles": string(rolesJSON),
+			"mapUsers": string(usersJSON),
+		},
+	}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMergeAwsAuth(t *testing.T) {
+	nodeRole := awsAuthRole{"arn:aws:iam::123456789012:role/node", "system:node:{{EC2PrivateDNSName}}", []string{"system:bootstrappers", "system:nodes"}}
+	mapRoles, err := renderAwsAuthRoles([]awsAuthRole{nodeRole}, []RoleMapping{
+		{RoleArn: "arn:aws:iam::123456789012:role/admin", Username: "admin", Groups: []string{"system:masters"}},
+	})
+	assert.NoError(t, err)
+	mapUsers, err := renderAwsAuthUsers(nil)
+	assert.NoError(t, err)
+
+	// Nothing to merge with on a new cluster
+	client := fake.NewSimpleClientset()
+	live, err := readAwsAuth(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Nil(t, live)
+	desired, err := mergeAwsAuth(live, mapRoles, mapUsers)
+	assert.NoError(t, err)
+	roles, users, err := parseAwsAuth(desired.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(roles))
+	assert.Equal(t, "[]", desired.Data["mapUsers"], "mapUsers should never be null")
+
+	// Written by the last update, then another tool added a role and a user in the YAML EKS uses
+	client = fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "aws-auth",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{awsAuthManagedAnnotation: `["arn:aws:iam::123456789012:role/admin","arn:aws:iam::123456789012:role/node","arn:aws:iam::123456789012:role/removed"]`},
+		},
+		Data: map[string]string{
+			"mapRoles": `- rolearn: arn:aws:iam::123456789012:role/node
+  username: system:node:{{EC2PrivateDNSName}}
+  groups: [system:bootstrappers, system:nodes]
+- rolearn: arn:aws:iam::123456789012:role/removed
+  username: removed
+- rolearn: arn:aws:iam::123456789012:role/admin
+  username: someone-else
+- rolearn: arn:aws:iam::123456789012:role/ci
+  username: ci
+  groups:
+    - deployers
+`,
+			"mapUsers": `- userarn: arn:aws:iam::123456789012:user/ops
+  username: ops
+`,
+		},
+	})
+	live, err = readAwsAuth(context.Background(), client)
+	assert.NoError(t, err)
+	desired, err = mergeAwsAuth(live, mapRoles, mapUsers)
+	assert.NoError(t, err)
+	roles, users, err = parseAwsAuth(desired.Data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []awsAuthRole{
+		nodeRole,
+		{"arn:aws:iam::123456789012:role/admin", "admin", []string{"system:masters"}},
+		{"arn:aws:iam::123456789012:role/ci", "ci", []string{"deployers"}},
+	}, roles, "The foreign role should survive, the one removed from config should not")
+	assert.Equal(t, []awsAuthUser{{"arn:aws:iam::123456789012:user/ops", "ops", []string{}}}, users)
+	assert.Equal(t, `["arn:aws:iam::123456789012:role/admin","arn:aws:iam::123456789012:role/node"]`, desired.Annotations[awsAuthManagedAnnotation],
+		"Only our own mappings should be recorded as managed")
+
+	// Owned entirely by an older version of this program, before mappings were recorded
+	live.Annotations = nil
+	live.Labels = map[string]string{"app.kubernetes.io/managed-by": "pulumi"}
+	desired, err = mergeAwsAuth(live, mapRoles, mapUsers)
+	assert.NoError(t, err)
+	roles, _, err = parseAwsAuth(desired.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(roles))
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Some EKS resources and functions only exist in newer releases of the AWS provider than the v5 SDK we build against.
+// They are registered by type token and pinned to this provider version, the engine runs that plugin next to v5.
+// The args below mirror the v6 SDK types, so moving to that SDK only means swapping the constructors.
+const awsNextVersion = "6.15.0"
+
+// Resource: EKS Addon
+// Purpose: Same as eks.Addon, plus configurationValues and the split conflict resolution settings.
+// Docs: https://www.pulumi.com/registry/packages/aws/api-docs/eks/addon/
+type eksAddon struct {
+	pulumi.CustomResourceState
+
+	AddonName    pulumi.StringOutput `pulumi:"addonName"`
+	AddonVersion pulumi.StringOutput `pulumi:"addonVersion"`
+	Arn          pulumi.StringOutput `pulumi:"arn"`
+}
+
+type eksAddonArgs struct {
+	AddonName                pulumi.StringInput
+	AddonVersion             pulumi.StringPtrInput
+	ClusterName              pulumi.StringInput
+	ConfigurationValues      pulumi.StringPtrInput
+	ResolveConflictsOnCreate pulumi.StringPtrInput
+	ResolveConflictsOnUpdate pulumi.StringPtrInput
+	ServiceAccountRoleArn    pulumi.StringPtrInput
+	Tags                     pulumi.StringMapInput
+}
+
+type eksAddonInputs struct {
+	AddonName                string            `pulumi:"addonName"`
+	AddonVersion             *string           `pulumi:"addonVersion"`
+	ClusterName              string            `pulumi:"clusterName"`
+	ConfigurationValues      *string           `pulumi:"configurationValues"`
+	ResolveConflictsOnCreate *string           `pulumi:"resolveConflictsOnCreate"`
+	ResolveConflictsOnUpdate *string           `pulumi:"resolveConflictsOnUpdate"`
+	ServiceAccountRoleArn    *string           `pulumi:"serviceAccountRoleArn"`
+	Tags                     map[string]string `pulumi:"tags"`
+}
+
+func (eksAddonArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksAddonInputs)(nil)).Elem()
+}
+
+func newEksAddon(ctx *pulumi.Context, name string, args *eksAddonArgs, opts ...pulumi.ResourceOption) (*eksAddon, error) {
+	var resource eksAddon
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.RegisterResource("aws:eks/addon:Addon", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+type getAddonVersionArgs struct {
+	AddonName         string `pulumi:"addonName"`
+	KubernetesVersion string `pulumi:"kubernetesVersion"`
+	MostRecent        bool   `pulumi:"mostRecent"`
+}
+
+type getAddonVersionResult struct {
+	Version string `pulumi:"version"`
+}
+
+// Returns the newest (or the default, unless mostRecent) addon version compatible with a Kubernetes version
+// Docs: https://www.pulumi.com/registry/packages/aws/api-docs/eks/getaddonversion/
+func getAddonVersion(ctx *pulumi.Context, args *getAddonVersionArgs, opts ...pulumi.InvokeOption) (string, error) {
+	var rv getAddonVersionResult
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.Invoke("aws:eks/getAddonVersion:getAddonVersion", args, &rv, opts...)
+	if err != nil {
+		return "", err
+	}
+	return rv.Version, nil
+}
+
+type getAddonVersionOutputArgs struct {
+	AddonName         pulumi.StringInput
+	KubernetesVersion pulumi.StringInput
+	MostRecent        pulumi.BoolInput
+}
+
+func (getAddonVersionOutputArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*getAddonVersionArgs)(nil)).Elem()
+}
+
+// Output form of getAddonVersion, for arguments only known once other resources exist. The Pulumi SDK we build
+// against has no output form of Invoke, so like the generated *Output functions of the v5 SDK it invokes in an ApplyT
+// once the arguments are known; previews with unknown arguments skip the lookup.
+func getAddonVersionOutput(ctx *pulumi.Context, args getAddonVersionOutputArgs, opts ...pulumi.InvokeOption) pulumi.StringOutput {
+	return pulumi.ToOutput(args).ApplyT(func(v interface{}) (string, error) {
+		args := v.(getAddonVersionArgs)
+		return getAddonVersion(ctx, &args, opts...)
+	}).(pulumi.StringOutput)
+}
+
+// Resource: EKS Cluster
+// Purpose: Same as eks.Cluster, plus the accessConfig the v5 ClusterArgs don't have.
+// Docs: https://www.pulumi.com/registry/packages/aws/api-docs/eks/cluster/#accessconfig
+type eksClusterArgs struct {
+	AccessConfig            *eksClusterAccessConfigArgs
+	EnabledClusterLogTypes  pulumi.StringArrayInput
+	EncryptionConfig        eks.ClusterEncryptionConfigPtrInput
+	KubernetesNetworkConfig eks.ClusterKubernetesNetworkConfigPtrInput
+	Name                    pulumi.StringPtrInput
+	RoleArn                 pulumi.StringInput
+	Tags                    pulumi.StringMapInput
+	Version                 pulumi.StringPtrInput
+	VpcConfig               eks.ClusterVpcConfigInput
+}
+
+type eksClusterInputs struct {
+	AccessConfig            *eksClusterAccessConfig             `pulumi:"accessConfig"`
+	EnabledClusterLogTypes  []string                            `pulumi:"enabledClusterLogTypes"`
+	EncryptionConfig        *eks.ClusterEncryptionConfig        `pulumi:"encryptionConfig"`
+	KubernetesNetworkConfig *eks.ClusterKubernetesNetworkConfig `pulumi:"kubernetesNetworkConfig"`
+	Name                    *string                             `pulumi:"name"`
+	RoleArn                 string                              `pulumi:"roleArn"`
+	Tags                    map[string]string                   `pulumi:"tags"`
+	Version                 *string                             `pulumi:"version"`
+	VpcConfig               eks.ClusterVpcConfig                `pulumi:"vpcConfig"`
+}
+
+func (eksClusterArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksClusterInputs)(nil)).Elem()
+}
+
+type eksClusterAccessConfigArgs struct {
+	AuthenticationMode                      pulumi.StringPtrInput
+	BootstrapClusterCreatorAdminPermissions pulumi.BoolPtrInput
+}
+
+type eksClusterAccessConfig struct {
+	AuthenticationMode                      *string `pulumi:"authenticationMode"`
+	BootstrapClusterCreatorAdminPermissions *bool   `pulumi:"bootstrapClusterCreatorAdminPermissions"`
+}
+
+func (eksClusterAccessConfigArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksClusterAccessConfig)(nil)).Elem()
+}
+
+// Only a cluster with an accessConfig goes through the newer provider, every other one stays on v5 as it always has
+func newEksCluster(ctx *pulumi.Context, name string, args *eks.ClusterArgs, accessConfig *eksClusterAccessConfigArgs, opts ...pulumi.ResourceOption) (*eks.Cluster, error) {
+	if accessConfig == nil {
+		return eks.NewCluster(ctx, name, args, opts...)
+	}
+	props := &eksClusterArgs{
+		AccessConfig:            accessConfig,
+		EnabledClusterLogTypes:  args.EnabledClusterLogTypes,
+		EncryptionConfig:        args.EncryptionConfig,
+		KubernetesNetworkConfig: args.KubernetesNetworkConfig,
+		Name:                    args.Name,
+		RoleArn:                 args.RoleArn,
+		Tags:                    args.Tags,
+		Version:                 args.Version,
+		VpcConfig:               args.VpcConfig,
+	}
+	var resource eks.Cluster
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.RegisterResource("aws:eks/cluster:Cluster", name, props, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// Resource: EKS Access Entry
+// Purpose: Grants an IAM principal access to the cluster without going through aws-auth.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/access-entries.html
+type eksAccessEntry struct {
+	pulumi.CustomResourceState
+
+	AccessEntryArn pulumi.StringOutput `pulumi:"accessEntryArn"`
+	PrincipalArn   pulumi.StringOutput `pulumi:"principalArn"`
+}
+
+type eksAccessEntryArgs struct {
+	ClusterName      pulumi.StringInput
+	KubernetesGroups pulumi.StringArrayInput
+	PrincipalArn     pulumi.StringInput
+	Type             pulumi.StringPtrInput
+	UserName         pulumi.StringPtrInput
+	Tags             pulumi.StringMapInput
+}
+
+type eksAccessEntryInputs struct {
+	ClusterName      string            `pulumi:"clusterName"`
+	KubernetesGroups []string          `pulumi:"kubernetesGroups"`
+	PrincipalArn     string            `pulumi:"principalArn"`
+	Type             *string           `pulumi:"type"`
+	UserName         *string           `pulumi:"userName"`
+	Tags             map[string]string `pulumi:"tags"`
+}
+
+func (eksAccessEntryArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksAccessEntryInputs)(nil)).Elem()
+}
+
+func newEksAccessEntry(ctx *pulumi.Context, name string, args *eksAccessEntryArgs, opts ...pulumi.ResourceOption) (*eksAccessEntry, error) {
+	var resource eksAccessEntry
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.RegisterResource("aws:eks/accessEntry:AccessEntry", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// Resource: EKS Access Policy Association
+// Purpose: Attaches one of the EKS managed access policies to an access entry, for the cluster or some namespaces.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/access-policies.html
+type eksAccessPolicyAssociation struct {
+	pulumi.CustomResourceState
+
+	PolicyArn pulumi.StringOutput `pulumi:"policyArn"`
+}
+
+type eksAccessPolicyAssociationArgs struct {
+	AccessScope  *eksAccessScopeArgs
+	ClusterName  pulumi.StringInput
+	PolicyArn    pulumi.StringInput
+	PrincipalArn pulumi.StringInput
+}
+
+type eksAccessPolicyAssociationInputs struct {
+	AccessScope  eksAccessScope `pulumi:"accessScope"`
+	ClusterName  string         `pulumi:"clusterName"`
+	PolicyArn    string         `pulumi:"policyArn"`
+	PrincipalArn string         `pulumi:"principalArn"`
+}
+
+func (eksAccessPolicyAssociationArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksAccessPolicyAssociationInputs)(nil)).Elem()
+}
+
+type eksAccessScopeArgs struct {
+	Namespaces pulumi.StringArrayInput
+	Type       pulumi.StringInput
+}
+
+type eksAccessScope struct {
+	Namespaces []string `pulumi:"namespaces"`
+	Type       string   `pulumi:"type"`
+}
+
+func (eksAccessScopeArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksAccessScope)(nil)).Elem()
+}
+
+func newEksAccessPolicyAssociation(ctx *pulumi.Context, name string, args *eksAccessPolicyAssociationArgs, opts ...pulumi.ResourceOption) (*eksAccessPolicyAssociation, error) {
+	var resource eksAccessPolicyAssociation
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.RegisterResource("aws:eks/accessPolicyAssociation:AccessPolicyAssociation", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// Registers a node group with the newer provider, the v5 provider rejects AMI types newer than itself (AL2023)
+// Docs: https://www.pulumi.com/registry/packages/aws/api-docs/eks/nodegroup/
+func newEksNodeGroup(ctx *pulumi.Context, name string, args *eks.NodeGroupArgs, opts ...pulumi.ResourceOption) (*eks.NodeGroup, error) {
+	var resource eks.NodeGroup
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.RegisterResource("aws:eks/nodeGroup:NodeGroup", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// Resource: EKS Pod Identity Association
+// Purpose: Binds an IAM role to a namespace and service account, the Pod Identity agent hands its credentials to the pods.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/pod-identities.html
+type eksPodIdentityAssociation struct {
+	pulumi.CustomResourceState
+
+	AssociationArn pulumi.StringOutput `pulumi:"associationArn"`
+	AssociationId  pulumi.StringOutput `pulumi:"associationId"`
+}
+
+type eksPodIdentityAssociationArgs struct {
+	ClusterName    pulumi.StringInput
+	Namespace      pulumi.StringInput
+	RoleArn        pulumi.StringInput
+	ServiceAccount pulumi.StringInput
+	Tags           pulumi.StringMapInput
+}
+
+type eksPodIdentityAssociationInputs struct {
+	ClusterName    string            `pulumi:"clusterName"`
+	Namespace      string            `pulumi:"namespace"`
+	RoleArn        string            `pulumi:"roleArn"`
+	ServiceAccount string            `pulumi:"serviceAccount"`
+	Tags           map[string]string `pulumi:"tags"`
+}
+
+func (eksPodIdentityAssociationArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*eksPodIdentityAssociationInputs)(nil)).Elem()
+}
+
+func newEksPodIdentityAssociation(ctx *pulumi.Context, name string, args *eksPodIdentityAssociationArgs, opts ...pulumi.ResourceOption) (*eksPodIdentityAssociation, error) {
+	var resource eksPodIdentityAssociation
+	opts = append(opts, pulumi.Version(awsNextVersion))
+	err := ctx.RegisterResource("aws:eks/podIdentityAssociation:PodIdentityAssociation", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
@@ -1,198 +1,218 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"strings"
+	"strconv"
 
-	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws"
-	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
-	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/helm/v3"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"aws-go-eks/iampolicy"
 )
 
 func setupDeployments(ctx *pulumi.Context, eksResources *eksResources, eksConfig *eksConfig) error {
 	/* DEPLOYMENTS */
-	if contains(eksConfig.Addons, "metricServer") {
-		_, err := helm.NewChart(ctx, "metrics-server", helm.ChartArgs{
-			Chart:     pulumi.String("metrics-server"),
-			Version:   pulumi.String("3.8.2"),
-			Namespace: pulumi.String("kube-system"),
-			FetchArgs: helm.FetchArgs{
-				Repo: pulumi.String("https://kubernetes-sigs.github.io/metrics-server/"),
-			},
-		}, pulumi.Provider(eksResources.k8sProvider))
-		if err != nil {
-			return err
-		}
+	affinity, err := addonAffinity(eksConfig)
+	if err != nil {
+		return err
 	}
 
-	current, err := aws.GetCallerIdentity(ctx, nil, nil)
+	cluster := &clusterIdentity{eksResources.eksCluster, eksResources.oidc, eksResources.k8sProvider}
+
+	workloadRoles, err := setupWorkloads(ctx, cluster, eksConfig.Workloads)
 	if err != nil {
 		return err
 	}
+	ctx.Export("workloadRoles", workloadRoles)
 
-	// we should get oidc provider & account_id
-	// ALB controller
-	if contains(eksConfig.Addons, "loadBalancerController") {
-		jsonPolicy := eksResources.oidcUrl.ApplyT(func(url string) string {
-			tmpAlbRole, err := json.Marshal(map[string]interface{}{
-				"Version": "2012-10-17",
-				"Statement": []map[string]interface{}{
-					map[string]interface{}{
-						"Action": "sts:AssumeRoleWithWebIdentity",
-						"Effect": "Allow",
-						"Sid":    "",
-						"Principal": map[string]interface{}{
-							//                                                    /<OIDC provider without https://
-							"Federated": "arn:aws:iam::" + current.AccountId + ":oidc-provider/" + strings.TrimPrefix(url, "https://"),
-						},
-						"Condition": map[string]interface{}{
-							"StringEquals": map[string]interface{}{
-								// Something like this , should be changed OIDC provider without https://
-								strings.TrimPrefix(url, "https://") + ":sub": "system:serviceaccount:kube-system:aws-load-balancer-controller",
-							},
-						},
-					},
-				},
-			})
-			if err != nil {
-				return "ERROR: " + err.Error()
-			}
-			return string(tmpAlbRole)
-		}).(pulumi.StringOutput)
-
-		file, _ := ioutil.ReadFile("policies/alb_iam_policy.json")
-		clusterLoadBalancerRole, err := iam.NewRole(ctx, "application-load-balancer-role", &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.StringInput(jsonPolicy),
-			InlinePolicies: iam.RoleInlinePolicyArray{
-				&iam.RoleInlinePolicyArgs{
-					Name:   pulumi.String("policy_for_loadbalancer_controller"),
-					Policy: pulumi.String(file),
-				},
-			},
-			Tags: pulumi.StringMap{
-				"tag-key": pulumi.String("tag-value"),
-			},
-		})
-
-		_, err = helm.NewChart(ctx, "aws-load-balancer-controller", helm.ChartArgs{
-			Chart:     pulumi.String("aws-load-balancer-controller"),
-			Version:   pulumi.String("1.4.1"),
-			Namespace: pulumi.String("kube-system"),
-			FetchArgs: helm.FetchArgs{
-				Repo: pulumi.String("https://aws.github.io/eks-charts"),
+	return setupAddons(ctx, &addonEnv{
+		eksResources: eksResources,
+		eksConfig:    eksConfig,
+		cluster:      cluster,
+		affinity:     affinity,
+		tolerations:  addonTolerations(),
+	})
+}
+
+// The load balancer controller's webhook mutates every Service, charts creating Services wait for it
+type metricsServerAddon struct{}
+
+func (metricsServerAddon) Name() string                        { return "metricsServer" }
+func (metricsServerAddon) After() []string                     { return []string{"loadBalancerController"} }
+func (metricsServerAddon) UsesAwsIdentity() bool               { return false }
+func (metricsServerAddon) Validate(eksConfig *eksConfig) error { return nil }
+
+func (metricsServerAddon) Chart(eksConfig *eksConfig) addonChart {
+	return addonChart{
+		Chart:     "metrics-server",
+		Version:   "3.8.2",
+		Namespace: "kube-system",
+		Repo:      "https://kubernetes-sigs.github.io/metrics-server/",
+	}
+}
+
+func (metricsServerAddon) Deploy(ctx *pulumi.Context, env *addonEnv, chart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	return chart.install(ctx, env.eksResources, "metrics-server", pulumi.Map{
+		"affinity":    env.affinity,
+		"tolerations": env.tolerations,
+	}, opts...)
+}
+
+type loadBalancerControllerAddon struct{}
+
+func (loadBalancerControllerAddon) Name() string                        { return "loadBalancerController" }
+func (loadBalancerControllerAddon) After() []string                     { return nil }
+func (loadBalancerControllerAddon) UsesAwsIdentity() bool               { return true }
+func (loadBalancerControllerAddon) Validate(eksConfig *eksConfig) error { return nil }
+
+func (loadBalancerControllerAddon) Chart(eksConfig *eksConfig) addonChart {
+	return addonChart{
+		Chart:     "aws-load-balancer-controller",
+		Version:   "1.4.1",
+		Namespace: "kube-system",
+		Repo:      "https://aws.github.io/eks-charts",
+	}
+}
+
+func (a loadBalancerControllerAddon) Deploy(ctx *pulumi.Context, env *addonEnv, chart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	file, err := ioutil.ReadFile("policies/alb_iam_policy.json")
+	if err != nil {
+		return nil, err
+	}
+	albPolicy, err := iampolicy.Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("policies/alb_iam_policy.json: %w", err)
+	}
+	_, albAnnotations, err := setupServiceAccountRole(ctx, "application-load-balancer-role", env.cluster, &serviceAccountRole{
+		namespace:       chart.Namespace,
+		serviceAccounts: []string{"aws-load-balancer-controller"},
+		mode:            env.eksConfig.AddonIdentity[a.Name()],
+		inlinePolicies:  []inlinePolicy{{"policy_for_loadbalancer_controller", albPolicy}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chart.install(ctx, env.eksResources, "aws-load-balancer-controller", pulumi.Map{
+		"clusterName": env.eksResources.eksCluster.Name,
+		"affinity":    env.affinity,
+		"tolerations": env.tolerations,
+		"serviceAccount": pulumi.Map{
+			"create":      pulumi.String("true"),
+			"name":        pulumi.String("aws-load-balancer-controller"),
+			"annotations": albAnnotations,
+		},
+	}, opts...)
+}
+
+type clusterAutoscalerAddon struct{}
+
+func (clusterAutoscalerAddon) Name() string          { return "clusterAutoscaller" }
+func (clusterAutoscalerAddon) After() []string       { return []string{"loadBalancerController"} }
+func (clusterAutoscalerAddon) UsesAwsIdentity() bool { return true }
+
+func (clusterAutoscalerAddon) Validate(eksConfig *eksConfig) error {
+	_, err := autoscalerExpander(eksConfig)
+	return err
+}
+
+func (clusterAutoscalerAddon) Chart(eksConfig *eksConfig) addonChart {
+	return addonChart{
+		Chart:     "cluster-autoscaler",
+		Version:   "9.19.0",
+		Namespace: "kube-system",
+		Repo:      "https://kubernetes.github.io/autoscaler",
+	}
+}
+
+func (a clusterAutoscalerAddon) Deploy(ctx *pulumi.Context, env *addonEnv, chart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	eksResources := env.eksResources
+	// Scaling is limited to the groups of this cluster, the node groups carry the cluster-autoscaler owner tag
+	autoscalingPolicy := iampolicy.Document{Statements: []iampolicy.Statement{
+		{
+			Actions: []string{
+				"autoscaling:SetDesiredCapacity",
+				"autoscaling:TerminateInstanceInAutoScalingGroup",
 			},
-			Values: pulumi.Map{
-				"clusterName": eksResources.eksCluster.Name,
-				"serviceAccount": pulumi.Map{
-					"create":      pulumi.String("true"),
-					"name":        pulumi.String("aws-load-balancer-controller"),
-					"annotations": pulumi.StringInput(clusterLoadBalancerRole.Arn),
-				},
+			Resources: iampolicy.Strings("*"),
+			Conditions: []iampolicy.Condition{{
+				Operator: iampolicy.StringEquals,
+				Key:      pulumi.String("aws:ResourceTag/k8s.io/cluster-autoscaler/" + eksResources.clusterName),
+				Values:   iampolicy.Strings("owned"),
+			}},
+		},
+		{
+			Actions: []string{
+				"autoscaling:DescribeAutoScalingInstances",
+				"autoscaling:DescribeAutoScalingGroups",
+				"ec2:DescribeLaunchTemplateVersions",
+				"autoscaling:DescribeTags",
+				"autoscaling:DescribeLaunchConfigurations",
 			},
-		}, pulumi.Provider(eksResources.k8sProvider))
-		if err != nil {
-			return err
+			Resources: iampolicy.Strings("*"),
+		},
+	}}
+
+	_, autoscalerAnnotations, err := setupServiceAccountRole(ctx, "cluster-autoscaler-role", env.cluster, &serviceAccountRole{
+		namespace:       chart.Namespace,
+		serviceAccounts: []string{"eks-autoscaler-sa"},
+		mode:            env.eksConfig.AddonIdentity[a.Name()],
+		inlinePolicies:  []inlinePolicy{{"policy-for-autoscaling", autoscalingPolicy}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expander, err := autoscalerExpander(env.eksConfig)
+	if err != nil {
+		return nil, err
+	}
+	priorities := pulumi.Map{}
+	if expander == "priority" {
+		for p, patterns := range expanderPriorities(eksResources.settings, env.eksConfig.NodeGroups) {
+			priorities[strconv.Itoa(p)] = toPulumiStringArray(patterns)
 		}
 	}
 
-	// Start of Cluster autoscaler
-	if contains(eksConfig.Addons, "clusterAutoscaller") {
-		jsonPolicyForAutoscaler := eksResources.oidcUrl.ApplyT(func(url string) string {
-			tmpAutoscalingRole, err := json.Marshal(map[string]interface{}{
-				"Version": "2012-10-17",
-				"Statement": []map[string]interface{}{
-					map[string]interface{}{
-						"Action": "sts:AssumeRoleWithWebIdentity",
-						"Effect": "Allow",
-						"Sid":    "",
-						"Principal": map[string]interface{}{
-							//                                                    /<OIDC provider without https://
-							"Federated": "arn:aws:iam::" + current.AccountId + ":oidc-provider/" + strings.TrimPrefix(url, "https://"),
-						},
-						"Condition": map[string]interface{}{
-							"StringEquals": map[string]interface{}{
-								// Something like this , should be changed OIDC provider without https://
-								strings.TrimPrefix(url, "https://") + ":sub": "system:serviceaccount:kube-system:eks-autoscaler-sa",
-							},
-						},
-					},
-				},
-			})
-			if err != nil {
-				return "ERROR: " + err.Error()
-			}
-			return string(tmpAutoscalingRole)
-		}).(pulumi.StringOutput)
-
-		jsonAutoscalingPolicy, _ := json.Marshal(map[string]interface{}{
-			"Version": "2012-10-17",
-			"Statement": []map[string]interface{}{
-				map[string]interface{}{
-					"Sid":    "",
-					"Effect": "Allow",
-					"Action": []string{
-						"autoscaling:SetDesiredCapacity",
-						"autoscaling:TerminateInstanceInAutoScalingGroup",
-					},
-					"Resource": "*",
-					"Condition": map[string]interface{}{
-						"StringEquals": map[string]interface{}{
-							fmt.Sprintf("aws:ResourceTag/k8s.io/cluster-autoscaler/%s", pulumi.StringInput(eksResources.eksCluster.Name)): "owned",
-						},
-					},
-				},
-				map[string]interface{}{
-					"Sid":    "",
-					"Effect": "Allow",
-					"Action": []string{
-						"autoscaling:DescribeAutoScalingInstances",
-						"autoscaling:DescribeAutoScalingGroups",
-						"ec2:DescribeLaunchTemplateVersions",
-						"autoscaling:DescribeTags",
-						"autoscaling:DescribeLaunchConfigurations",
-					},
-					"Resource": "*",
-				},
-			},
-		})
-
-		clusterAutoscalerRole, err := iam.NewRole(ctx, "cluster-autoscaler-role", &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.StringInput(jsonPolicyForAutoscaler),
-			InlinePolicies: iam.RoleInlinePolicyArray{
-				&iam.RoleInlinePolicyArgs{
-					Name:   pulumi.String("policy-for-autoscaling"),
-					Policy: pulumi.String(jsonAutoscalingPolicy),
-				},
-			},
-			Tags: pulumi.StringMap{
-				"tag-key": pulumi.String("tag-value"),
-			},
-		})
-
-		_, err = helm.NewChart(ctx, "cluster-autoscaler", helm.ChartArgs{
-			Chart:     pulumi.String("autoscaler/cluster-autoscaler"),
-			Version:   pulumi.String("9.19.0"),
-			Namespace: pulumi.String("kube-system"),
-			FetchArgs: helm.FetchArgs{
-				Repo: pulumi.String("https://kubernetes.github.io/autoscaler"),
+	// Nested rather than a dotted key, so values from the addon settings merge into it. The autoscaler only uses
+	// the name to find the owner tag of the node groups, which is the stack scoped name and not the cluster's.
+	return chart.install(ctx, eksResources, "cluster-autoscaler", pulumi.Map{
+		"autoDiscovery": pulumi.Map{
+			"clusterName": pulumi.String(eksResources.clusterName),
+		},
+		"affinity":    env.affinity,
+		"tolerations": env.tolerations,
+		"extraArgs": pulumi.Map{
+			"expander":                    pulumi.String(expander),
+			"balance-similar-node-groups": pulumi.Bool(true),
+		},
+		"expanderPriorities": priorities,
+		"rbac": pulumi.Map{
+			"serviceAccount": pulumi.Map{
+				"name":        pulumi.String("eks-autoscaler-sa"),
+				"annotations": autoscalerAnnotations,
 			},
-			Values: pulumi.Map{
-				"autoDiscovery.clusterName": pulumi.StringInput(eksResources.eksCluster.Name),
-				"rbac": pulumi.Map{
-					"serviceAccount": pulumi.Map{
-						"name":        pulumi.String("eks-autoscaler-sa"),
-						"annotations": pulumi.StringInput(clusterAutoscalerRole.Arn),
-					},
-				},
-			},
-		}, pulumi.Provider(eksResources.k8sProvider))
-		if err != nil {
-			return err
+		},
+	}, opts...)
+}
+
+var autoscalerExpanders = []string{"random", "most-pods", "least-waste", "price", "priority"}
+
+// Mixed spot and on-demand groups default to the priority expander, so spot capacity is used first and
+// on-demand only when spot can't be had. The priorities end up in the chart's priority-expander ConfigMap.
+// Docs: https://github.com/kubernetes/autoscaler/blob/master/cluster-autoscaler/FAQ.md#what-are-expanders
+func autoscalerExpander(eksConfig *eksConfig) (string, error) {
+	expander := eksConfig.ClusterAutoscaler.Expander
+	if expander == "" {
+		expander = "least-waste"
+		for _, ng := range eksConfig.NodeGroups {
+			if ng.CapacityType == "SPOT" || ng.System {
+				expander = "priority"
+			}
 		}
 	}
-
-	return nil
+	if !contains(autoscalerExpanders, expander) {
+		return "", fmt.Errorf("clusterAutoscaler.expander must be one of %v, got %q", autoscalerExpanders, expander)
+	}
+	return expander, nil
 }
@@ -3,45 +3,54 @@ package main
 import (
 	"fmt"
 
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/cloudwatch"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/kms"
+	corev1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/core/v1"
 	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"aws-go-eks/iampolicy"
 )
 
+// Control plane log types accepted by EKS
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/control-plane-logs.html
+var clusterLogTypes = []string{"api", "audit", "authenticator", "controllerManager", "scheduler"}
+
+// Retention periods accepted by CloudWatch Logs, 0 means never expire
+var logRetentionDays = []int{0, 1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1827, 3653}
+
 type eksResources struct {
 	k8sProvider *providers.Provider
-	oidcUrl     pulumi.StringOutput
-	eksCluster  *eks.Cluster
+	// Only set when an addon is installed as a Helm release, see k8snext.go
+	helmProvider *providers.Provider
+	oidc         *oidcProvider
+	eksCluster   *eks.Cluster
+	// Stack scoped name used in tags and names derived from the cluster, the cluster itself may be auto-named
+	clusterName string
+	nodeRole    *iam.Role
+	settings    *stackSettings
+	// Namespaces created for addons installed as charts, by name
+	namespaces map[string]*corev1.Namespace
 }
 
-func setupEKS(ctx *pulumi.Context, netResources *networkResources, eksConfig *eksConfig) (*eksResources, error) {
-	prefix := "pulumi-eks-go"
-	resourceTags := make(map[string]string)
-
-	resourceTags["CreatedBy"] = "pulumi-eks-go"
-	resourceTags["GitOrg"] = "gsweene2"
-	resourceTags["GitRepo"] = "pulumi"
+func eksClusterName(settings *stackSettings) string {
+	return physicalName(settings, "eks", maxClusterNameLength)
+}
 
-	// VPC Args
-	resourceTags["Name"] = prefix + "-eks"
+func setupEKS(ctx *pulumi.Context, settings *stackSettings, netResources *networkResources, eksConfig *eksConfig) (*eksResources, error) {
+	// The common tags come from the stack transformation, only Name is set here
+	clusterName := eksClusterName(settings)
+	resourceTags := map[string]string{"Name": clusterName}
 
 	// Resource: IAM Role
 	// Purpose: An IAM role is an IAM identity that you can create in your account that has specific permissions.
 	// Docs: https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles.html
 	eksRole, err := iam.NewRole(ctx, "eks-iam-eksRole", &iam.RoleArgs{
-		AssumeRolePolicy: pulumi.String(`{
-			    "Version": "2008-10-17",
-			    "Statement": [{
-			        "Sid": "",
-			        "Effect": "Allow",
-			        "Principal": {
-			            "Service": "eks.amazonaws.com"
-			        },
-			        "Action": "sts:AssumeRole"
-			    }]
-			}`),
+		AssumeRolePolicy: iampolicy.ServiceTrust("eks.amazonaws.com").ToStringOutput(),
 	})
 	if err != nil {
 		return nil, err
@@ -61,27 +70,12 @@ func setupEKS(ctx *pulumi.Context, netResources *networkResources, eksConfig *ek
 	}
 	// Create the EC2 NodeGroup Role
 	nodeGroupRole, err := iam.NewRole(ctx, "nodegroup-iam-role", &iam.RoleArgs{
-		AssumeRolePolicy: pulumi.String(`{
-		    "Version": "2012-10-17",
-		    "Statement": [{
-		        "Sid": "",
-		        "Effect": "Allow",
-		        "Principal": {
-		            "Service": "ec2.amazonaws.com"
-		        },
-		        "Action": "sts:AssumeRole"
-		    }]
-		}`),
+		AssumeRolePolicy: iampolicy.ServiceTrust("ec2.amazonaws.com").ToStringOutput(),
 	})
 	if err != nil {
 		return nil, err
 	}
-	nodeGroupPolicies := []string{
-		"arn:aws:iam::aws:policy/AmazonEKSWorkerNodePolicy",
-		"arn:aws:iam::aws:policy/AmazonEKS_CNI_Policy",
-		"arn:aws:iam::aws:policy/AmazonEC2ContainerRegistryReadOnly",
-	}
-	for i, nodeGroupPolicy := range nodeGroupPolicies {
+	for i, nodeGroupPolicy := range nodeRolePolicies(&eksConfig.NodeAccess) {
 		_, err := iam.NewRolePolicyAttachment(ctx, fmt.Sprintf("ngpa-%d", i), &iam.RolePolicyAttachmentArgs{
 			Role:      nodeGroupRole.Name,
 			PolicyArn: pulumi.String(nodeGroupPolicy),
@@ -90,6 +84,16 @@ func setupEKS(ctx *pulumi.Context, netResources *networkResources, eksConfig *ek
 			return nil, err
 		}
 	}
+	if eksConfig.NodeAccess.SsmEndpoints {
+		if !eksConfig.NodeAccess.Ssm {
+			return nil, fmt.Errorf("nodeAccess.ssmEndpoints needs nodeAccess.ssm")
+		}
+		err = setupSsmEndpoints(ctx, netResources)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a Security Group that we can use to actually connect to our cluster
 	ingressRules := ec2.SecurityGroupIngressArray{}
 	for _, v := range eksConfig.Sg.Ingress {
@@ -132,9 +136,49 @@ func setupEKS(ctx *pulumi.Context, netResources *networkResources, eksConfig *ek
 		pubSubnetsIDs = append(pubSubnetsIDs, v.ID())
 	}
 
+	// Resource: CloudWatch Log Group
+	// Purpose: Receives the control plane logs, created upfront so retention and encryption are managed by us and not by EKS.
+	// Docs: https://docs.aws.amazon.com/eks/latest/userguide/control-plane-logs.html
+	clusterDeps := []pulumi.Resource{}
+	if err := validateLogging(&eksConfig.Logging); err != nil {
+		return nil, err
+	}
+	physicalClusterName := clusterPhysicalName(settings, eksConfig)
+	if len(eksConfig.Logging.Types) > 0 {
+		logGroup, err := setupClusterLogGroup(ctx, physicalClusterName, &eksConfig.Logging, resourceTags)
+		if err != nil {
+			return nil, err
+		}
+		clusterDeps = append(clusterDeps, logGroup)
+	}
+
+	// Resource: KMS Key
+	// Purpose: Envelope encryption of Kubernetes Secrets stored in etcd.
+	// Docs: https://docs.aws.amazon.com/eks/latest/userguide/enable-kms.html
+	var encryptionConfig eks.ClusterEncryptionConfigPtrInput
+	if eksConfig.Encryption.Enabled {
+		keyArn, err := setupSecretsKey(ctx, clusterName, eksRole, &eksConfig.Encryption, resourceTags)
+		if err != nil {
+			return nil, err
+		}
+		encryptionConfig = &eks.ClusterEncryptionConfigArgs{
+			Provider: &eks.ClusterEncryptionConfigProviderArgs{
+				KeyArn: keyArn,
+			},
+			Resources: pulumi.StringArray{pulumi.String("secrets")},
+		}
+	}
+
+	accessConfig, err := clusterAccessConfig(&eksConfig.Access)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create EKS Cluster
-	eksCluster, err := eks.NewCluster(ctx, "eks-cluster", &eks.ClusterArgs{
-		RoleArn: pulumi.StringInput(eksRole.Arn),
+	clusterArgs := &eks.ClusterArgs{
+		EnabledClusterLogTypes: toPulumiStringArray(eksConfig.Logging.Types),
+		EncryptionConfig:       encryptionConfig,
+		RoleArn:                pulumi.StringInput(eksRole.Arn),
 		VpcConfig: &eks.ClusterVpcConfigArgs{
 			PublicAccessCidrs: pulumi.StringArray{
 				pulumi.String("0.0.0.0/0"),
@@ -145,68 +189,235 @@ func setupEKS(ctx *pulumi.Context, netResources *networkResources, eksConfig *ek
 			SubnetIds: append(privSubnetsIDs, pubSubnetsIDs...),
 		},
 		Tags: pulumi.ToStringMap(resourceTags),
-	})
+	}
+	if physicalClusterName != "" {
+		clusterArgs.Name = pulumi.String(physicalClusterName)
+	}
+	eksCluster, err := newEksCluster(ctx, "eks-cluster", clusterArgs, accessConfig, pulumi.DependsOn(clusterDeps))
+	if err != nil {
+		return nil, err
+	}
+
+	accessDeps, err := setupAccessEntries(ctx, eksCluster, eksConfig, nodeGroupRole)
+	if err != nil {
+		return nil, err
+	}
+
+	oidc, err := setupOidcProvider(ctx, eksCluster, eksConfig)
 	if err != nil {
 		return nil, err
 	}
+	ctx.Export("oidcProviderArn", oidc.arn)
+	ctx.Export("oidcIssuer", oidc.issuer)
+
+	ca := eksCluster.CertificateAuthorities.ApplyT(func(certificateAuthorities []eks.ClusterCertificateAuthority) (string, error) {
+		return (*certificateAuthorities[0].Data), nil
+	}).(pulumi.StringOutput)
 
-	oidc_url := eksCluster.Identities.Index(pulumi.Int(0)).Oidcs().Index(pulumi.Int(0)).Issuer().Elem().ToStringOutput()
-	thumbprint := oidc_url.ApplyT(func(url string) string {
-		res, err := getThumbprint(url)
+	kubeAuth, err := newKubeconfigAuth(ctx, &eksConfig.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	kubeconfig := generateKubeconfig(eksCluster.Endpoint, ca, eksCluster.Name, kubeAuth)
+
+	profiles := fargateProfiles(eksConfig)
+	var fargateRole *iam.Role
+	if len(profiles) > 0 {
+		fargateRole, err = setupFargatePodExecutionRole(ctx)
 		if err != nil {
-			fmt.Println("ERROR: ", err)
+			return nil, err
 		}
-		return res
-	}).(pulumi.StringOutput)
+	}
 
+	authDeps := accessDeps
+	if awsAuthEnabled(&eksConfig.Access) {
+		// Only needed to bootstrap aws-auth before any node tries to join, everything else waits for the compute.
+		// Server-side apply adopts the aws-auth EKS may have created already.
+		bootstrapProvider, err := newK8sNextProvider(ctx, "k8sprovider-bootstrap", &k8sNextProviderArgs{
+			EnableServerSideApply: pulumi.Bool(true),
+			Kubeconfig:            kubeconfig,
+		})
+		if err != nil {
+			return nil, err
+		}
+		awsAuth, err := setupAwsAuth(ctx, bootstrapProvider, kubeconfig, nodeGroupRole, fargateRole, &eksConfig.Access)
+		if err != nil {
+			return nil, err
+		}
+		authDeps = append(authDeps, awsAuth)
+	}
+	afterAwsAuth := pulumi.DependsOn(authDeps)
+
+	nodeGroups, err := setupNodeGroups(ctx, settings, clusterName, eksCluster, ca, nodeGroupRole, netResources, withReleaseVersion(eksConfig.NodeGroups, eksConfig.NodeReleaseVersion), afterAwsAuth)
 	if err != nil {
 		return nil, err
 	}
-	_, err = iam.NewOpenIdConnectProvider(ctx, "eks-oidc", &iam.OpenIdConnectProviderArgs{
-		ClientIdLists:   pulumi.StringArray{pulumi.String("sts.amazonaws.com")},
-		ThumbprintLists: pulumi.StringArray{pulumi.StringInput(thumbprint)},
-		Url:             oidc_url,
-	})
+
+	// Karpenter nodes share the security group EKS creates for the cluster with the managed node groups
+	for k, v := range karpenterDiscoveryTags(settings, eksConfig) {
+		_, err = ec2.NewTag(ctx, "cluster-sg-"+k, &ec2.TagArgs{
+			ResourceId: eksCluster.VpcConfig.ClusterSecurityGroupId().Elem(),
+			Key:        pulumi.String(k),
+			Value:      pulumi.String(v),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fargateProfiles, err := setupFargateProfiles(ctx, eksCluster, fargateRole, netResources, profiles, resourceTags, afterAwsAuth)
+	if err != nil {
+		return nil, err
+	}
+	computeDeps := nodeGroupDeps(nodeGroups)
+	for _, p := range fargateProfiles {
+		computeDeps = append(computeDeps, p)
+	}
+
+	// Managed addons go last, coredns only becomes healthy once there is compute to schedule it on
+	err = setupManagedAddons(ctx, eksCluster, oidc, withPodIdentityAgent(eksConfig), computeDeps)
+	if err != nil {
+		return nil, err
+	}
+
+	err = exportKubeconfigs(ctx, eksCluster, ca, kubeAuth, eksConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	k8sProvider, err := providers.NewProvider(ctx, "k8sprovider", &providers.ProviderArgs{
+		Kubeconfig: kubeconfig,
+	}, pulumi.DependsOn(computeDeps))
+	if err != nil {
+		return nil, err
+	}
+
+	var helmProvider *providers.Provider
+	if helmReleasesEnabled(eksConfig) {
+		helmProvider, err = newK8sNextProvider(ctx, "k8sprovider-helm", &k8sNextProviderArgs{
+			Kubeconfig: kubeconfig,
+		}, pulumi.DependsOn(computeDeps))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if coreDnsOnFargate(eksConfig) {
+		err = patchCoreDnsForFargate(ctx, k8sProvider)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &eksResources{
+		k8sProvider:  k8sProvider,
+		helmProvider: helmProvider,
+		oidc:         oidc,
+		eksCluster:   eksCluster,
+		clusterName:  clusterName,
+		nodeRole:     nodeGroupRole,
+		settings:     settings,
+	}, nil
+}
+
+// Physical name of the cluster, empty when Pulumi auto-names it. The control plane log group is named after the
+// cluster and has to exist before it, so a cluster with logs gets the stack scoped name unless eks.clusterName is set.
+// A new name replaces the control plane.
+func clusterPhysicalName(settings *stackSettings, eksConfig *eksConfig) string {
+	if eksConfig.ClusterName != "" {
+		return eksConfig.ClusterName
+	}
+	if len(eksConfig.Logging.Types) > 0 {
+		return eksClusterName(settings)
+	}
+	return ""
+}
+
+func validateLogging(logging *Logging) error {
+	for _, t := range logging.Types {
+		if !contains(clusterLogTypes, t) {
+			return fmt.Errorf("unknown cluster log type %q, valid types are %v", t, clusterLogTypes)
+		}
+	}
+	if !containsInt(logRetentionDays, logging.RetentionDays) {
+		return fmt.Errorf("invalid log retention of %d days, valid values are %v", logging.RetentionDays, logRetentionDays)
+	}
+	return nil
+}
+
+func setupClusterLogGroup(ctx *pulumi.Context, clusterName string, logging *Logging, tags map[string]string) (*cloudwatch.LogGroup, error) {
+	logGroupArgs := &cloudwatch.LogGroupArgs{
+		// EKS always writes to this exact name, so it must match the cluster name
+		Name:            pulumi.String(fmt.Sprintf("/aws/eks/%s/cluster", clusterName)),
+		RetentionInDays: pulumi.Int(logging.RetentionDays),
+		Tags:            pulumi.ToStringMap(tags),
+	}
+	if logging.KmsKeyArn != "" {
+		logGroupArgs.KmsKeyId = pulumi.String(logging.KmsKeyArn)
+	}
+	return cloudwatch.NewLogGroup(ctx, "eks-cluster-logs", logGroupArgs)
+}
+
+// Returns the ARN of the key used for secrets encryption, either the configured one or a new key owned by this stack
+func setupSecretsKey(ctx *pulumi.Context, clusterName string, eksRole *iam.Role, encryption *Encryption, tags map[string]string) (pulumi.StringInput, error) {
+	if encryption.KmsKeyArn != "" {
+		return pulumi.String(encryption.KmsKeyArn), nil
+	}
+
+	current, err := aws.GetCallerIdentity(ctx, nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	// END
 
-	nodeGroup, err := eks.NewNodeGroup(ctx, "node-group-2", &eks.NodeGroupArgs{
-		ClusterName:   eksCluster.Name,
-		NodeGroupName: pulumi.String("demo-eks-nodegroup-2"),
-		NodeRoleArn:   pulumi.StringInput(nodeGroupRole.Arn),
-		InstanceTypes: pulumi.StringArray{pulumi.String(eksConfig.NodeGroup.NodeType)},
-		CapacityType:  pulumi.String(eksConfig.NodeGroup.CapacityType),
-		SubnetIds:     privSubnetsIDs,
-		ScalingConfig: &eks.NodeGroupScalingConfigArgs{
-			DesiredSize: pulumi.Int(eksConfig.NodeGroup.Scaling.Desire),
-			MaxSize:     pulumi.Int(eksConfig.NodeGroup.Scaling.Max),
-			MinSize:     pulumi.Int(eksConfig.NodeGroup.Scaling.Min),
+	// The account root keeps administrative access, the cluster role only gets the usage it needs. In a key policy
+	// the "*" resource is the key itself, so wildcard actions are fine
+	keyPolicy := iampolicy.Document{Statements: []iampolicy.Statement{
+		{
+			Sid:           "EnableRootPermissions",
+			Principals:    []iampolicy.Principal{{Type: iampolicy.AWS, Identifiers: iampolicy.Strings("arn:aws:iam::" + current.AccountId + ":root")}},
+			Actions:       []string{"kms:*"},
+			Resources:     iampolicy.Strings("*"),
+			AllowWildcard: true,
 		},
-		Tags: pulumi.StringMap{
-			fmt.Sprintf("k8s.io/cluster-autoscaler/%s", pulumi.StringInput(eksCluster.Name)): pulumi.String("owned"),
-			"k8s.io/cluster-autoscaler/enabled":                                              pulumi.String("true"),
+		{
+			Sid:        "AllowClusterRoleUsage",
+			Principals: []iampolicy.Principal{{Type: iampolicy.AWS, Identifiers: []pulumi.StringInput{eksRole.Arn}}},
+			Actions: []string{
+				"kms:Encrypt",
+				"kms:Decrypt",
+				"kms:ReEncrypt*",
+				"kms:GenerateDataKey*",
+				"kms:DescribeKey",
+				"kms:CreateGrant",
+			},
+			Resources:     iampolicy.Strings("*"),
+			AllowWildcard: true,
 		},
+	}}
+
+	key, err := kms.NewKey(ctx, "eks-secrets-key", &kms.KeyArgs{
+		Description:          pulumi.String(fmt.Sprintf("Kubernetes secrets encryption for %s", clusterName)),
+		EnableKeyRotation:    pulumi.Bool(true),
+		DeletionWindowInDays: pulumi.Int(30),
+		Policy:               keyPolicy.ToStringOutput(),
+		Tags:                 pulumi.ToStringMap(tags),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	ca := eksCluster.CertificateAuthorities.ApplyT(func(certificateAuthorities []eks.ClusterCertificateAuthority) (string, error) {
-		return (*certificateAuthorities[0].Data), nil
-	}).(pulumi.StringOutput)
-
-	ctx.Export("kubeconfig", generateKubeconfig(eksCluster.Endpoint,
-		ca, eksCluster.Name))
-
-	k8sProvider, err := providers.NewProvider(ctx, "k8sprovider", &providers.ProviderArgs{
-		Kubeconfig: generateKubeconfig(eksCluster.Endpoint,
-			ca, eksCluster.Name),
-	}, pulumi.DependsOn([]pulumi.Resource{nodeGroup}))
+	alias := encryption.KeyAlias
+	if alias == "" {
+		alias = "alias/" + clusterName + "-secrets"
+	}
+	_, err = kms.NewAlias(ctx, "eks-secrets-key-alias", &kms.AliasArgs{
+		Name:        pulumi.String(alias),
+		TargetKeyId: key.KeyId,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &eksResources{k8sProvider, oidc_url, eksCluster}, nil
+	return key.Arn, nil
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterPhysicalName(t *testing.T) {
+	settings := &stackSettings{NamePrefix: "dev"}
+	assert.Equal(t, "", clusterPhysicalName(settings, &eksConfig{}), "Without logs Pulumi keeps naming the cluster")
+
+	// The log group has to be created under the cluster's name before the cluster exists
+	config := &eksConfig{Logging: Logging{Types: []string{"api"}, RetentionDays: 30}}
+	assert.Equal(t, eksClusterName(settings), clusterPhysicalName(settings, config))
+	assert.Equal(t, "dev-eks", clusterPhysicalName(settings, config))
+
+	config.ClusterName = "demo"
+	assert.Equal(t, "demo", clusterPhysicalName(settings, config))
+}
+
+func TestSecretsKey(t *testing.T) {
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		eksRole, err := iam.NewRole(ctx, "eks-iam-eksRole", &iam.RoleArgs{AssumeRolePolicy: pulumi.String("{}")})
+		assert.NoError(t, err)
+
+		own, err := setupSecretsKey(ctx, "dev-eks", eksRole, &Encryption{Enabled: true, KmsKeyArn: "arn:aws:kms:eu-west-1:123456789012:key/own"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, pulumi.String("arn:aws:kms:eu-west-1:123456789012:key/own"), own, "A configured key is used as is")
+
+		_, err = setupSecretsKey(ctx, "dev-eks", eksRole, &Encryption{Enabled: true}, nil)
+		assert.NoError(t, err)
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	key := m.inputs["eks-secrets-key"]
+	assert.True(t, key["enableKeyRotation"].BoolValue())
+	var policy struct {
+		Statement []struct {
+			Sid       string
+			Principal map[string]string
+			Action    interface{}
+		}
+	}
+	assert.NoError(t, json.Unmarshal([]byte(key["policy"].StringValue()), &policy))
+	assert.Equal(t, "arn:aws:iam::123456789012:root", policy.Statement[0].Principal["AWS"])
+	assert.Equal(t, "AllowClusterRoleUsage", policy.Statement[1].Sid)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/eks-iam-eksRole", policy.Statement[1].Principal["AWS"])
+	assert.Equal(t, "alias/dev-eks-secrets", m.inputs["eks-secrets-key-alias"]["name"].StringValue())
+}
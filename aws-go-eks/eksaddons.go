@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+type managedAddonRole struct {
+	namespace      string
+	serviceAccount string
+	policyArn      string
+}
+
+// Addons calling AWS APIs get a role for their service account (IRSA or Pod Identity) instead of borrowing the node role
+var managedAddonRoles = map[string]managedAddonRole{
+	"vpc-cni":            {"kube-system", "aws-node", "arn:aws:iam::aws:policy/AmazonEKS_CNI_Policy"},
+	"aws-ebs-csi-driver": {"kube-system", "ebs-csi-controller-sa", "arn:aws:iam::aws:policy/service-role/AmazonEBSCSIDriverPolicy"},
+}
+
+var addonConflictResolutions = []string{"OVERWRITE", "NONE", "PRESERVE"}
+
+// Resource: EKS Addon
+// Purpose: Lets EKS install and upgrade vpc-cni, coredns, kube-proxy and friends instead of the self-managed defaults.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/eks-add-ons.html
+func setupManagedAddons(ctx *pulumi.Context, eksCluster *eks.Cluster, oidc *oidcProvider, managedAddons map[string]ManagedAddon, deps []pulumi.Resource) error {
+	if len(managedAddons) == 0 {
+		return nil
+	}
+
+	cluster := &clusterIdentity{eksCluster, oidc, nil}
+
+	names := make([]string, 0, len(managedAddons))
+	for name := range managedAddons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		addon := managedAddons[name]
+
+		resolveConflicts := addon.ResolveConflicts
+		if resolveConflicts == "" {
+			resolveConflicts = "OVERWRITE"
+		}
+		if !contains(addonConflictResolutions, resolveConflicts) {
+			return fmt.Errorf("managed addon %s: resolveConflicts must be one of %v", name, addonConflictResolutions)
+		}
+
+		args := &eksAddonArgs{
+			ClusterName: eksCluster.Name,
+			AddonName:   pulumi.String(name),
+			// PRESERVE only makes sense for an update, there is nothing to preserve on create
+			ResolveConflictsOnCreate: pulumi.String("OVERWRITE"),
+			ResolveConflictsOnUpdate: pulumi.String(resolveConflicts),
+		}
+
+		switch addon.Version {
+		case "":
+			// Whatever EKS considers the default for the cluster version
+		case "latest":
+			args.AddonVersion = getAddonVersionOutput(ctx, getAddonVersionOutputArgs{
+				AddonName:         pulumi.String(name),
+				KubernetesVersion: eksCluster.Version,
+				MostRecent:        pulumi.Bool(true),
+			})
+		default:
+			args.AddonVersion = pulumi.String(addon.Version)
+		}
+
+		if addon.ConfigurationValues != "" {
+			if !json.Valid([]byte(addon.ConfigurationValues)) {
+				return fmt.Errorf("managed addon %s: configurationValues is not valid JSON", name)
+			}
+			args.ConfigurationValues = pulumi.String(addon.ConfigurationValues)
+		}
+
+		if r, ok := managedAddonRoles[name]; ok {
+			role, _, err := setupServiceAccountRole(ctx, name+"-addon-role", cluster, &serviceAccountRole{
+				namespace:       r.namespace,
+				serviceAccounts: []string{r.serviceAccount},
+				mode:            addon.Identity,
+				policyArns:      []string{r.policyArn},
+			})
+			if err != nil {
+				return err
+			}
+			// EKS annotates the addon's service account itself, with Pod Identity the association is all it takes
+			if addon.Identity != identityPodIdentity {
+				args.ServiceAccountRoleArn = role.Arn
+			}
+		} else if addon.Identity != "" {
+			return fmt.Errorf("managed addon %s doesn't call AWS APIs, identity can't be set", name)
+		}
+
+		_, err := newEksAddon(ctx, name+"-addon", args, pulumi.DependsOn(deps))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
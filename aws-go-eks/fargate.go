@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	batchv1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/batch/v1"
+	corev1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/core/v1"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	rbacv1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/rbac/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"aws-go-eks/iampolicy"
+)
+
+const coreDnsPatchName = "coredns-fargate-patch"
+
+// Pinned so the patch job runs the same kubectl on every deployment
+const kubectlImage = "alpine/k8s:1.30.4"
+
+// Selectors of the profile that runs CoreDNS, and the job removing its EC2 pinning, on Fargate
+var coreDnsFargateProfile = FargateProfile{
+	Name: "coredns",
+	Selectors: []FargateSelector{
+		{Namespace: "kube-system", Labels: map[string]string{"k8s-app": "kube-dns"}},
+		{Namespace: "kube-system", Labels: map[string]string{"app.kubernetes.io/name": coreDnsPatchName}},
+	},
+}
+
+// CoreDNS has to move to Fargate when there is no node group for it to run on
+func coreDnsOnFargate(eksConfig *eksConfig) bool {
+	return eksConfig.CoreDnsOnFargate || (len(eksConfig.NodeGroups) == 0 && len(eksConfig.FargateProfiles) > 0)
+}
+
+// Profiles from the config, plus the CoreDNS one when it has to run on Fargate
+func fargateProfiles(eksConfig *eksConfig) []FargateProfile {
+	profiles := append([]FargateProfile{}, eksConfig.FargateProfiles...)
+	if coreDnsOnFargate(eksConfig) {
+		profiles = append(profiles, coreDnsFargateProfile)
+	}
+	return profiles
+}
+
+func setupFargatePodExecutionRole(ctx *pulumi.Context) (*iam.Role, error) {
+	podExecutionRole, err := iam.NewRole(ctx, "fargate-pod-execution-role", &iam.RoleArgs{
+		AssumeRolePolicy: iampolicy.ServiceTrust("eks-fargate-pods.amazonaws.com").ToStringOutput(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = iam.NewRolePolicyAttachment(ctx, "fargate-pod-execution-rpa", &iam.RolePolicyAttachmentArgs{
+		Role:      podExecutionRole.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/AmazonEKSFargatePodExecutionRolePolicy"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return podExecutionRole, nil
+}
+
+// Resource: Fargate Profile
+// Purpose: Runs the pods matching a namespace and labels on Fargate instead of EC2 nodes.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/fargate-profile.html
+func setupFargateProfiles(ctx *pulumi.Context, eksCluster *eks.Cluster, podExecutionRole *iam.Role, netResources *networkResources, profiles []FargateProfile, tags map[string]string, opts ...pulumi.ResourceOption) ([]*eks.FargateProfile, error) {
+	res := []*eks.FargateProfile{}
+	// EKS creates or deletes one profile of a cluster at a time, each one waits for the previous
+	var previous []pulumi.Resource
+	for _, p := range profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("every fargate profile needs a name")
+		}
+		if len(p.Selectors) == 0 || len(p.Selectors) > 5 {
+			return nil, fmt.Errorf("fargate profile %s needs between 1 and 5 selectors", p.Name)
+		}
+		// Fargate pods never get a public IP, so only private subnets are accepted
+		if p.Subnets != "" && p.Subnets != "private" {
+			return nil, fmt.Errorf("fargate profile %s: only private subnets are supported, got %q", p.Name, p.Subnets)
+		}
+		subnetIds, err := nodeGroupSubnets(netResources, "private")
+		if err != nil {
+			return nil, err
+		}
+
+		selectors := eks.FargateProfileSelectorArray{}
+		for _, s := range p.Selectors {
+			selectors = append(selectors, eks.FargateProfileSelectorArgs{
+				Namespace: pulumi.String(s.Namespace),
+				Labels:    pulumi.ToStringMap(s.Labels),
+			})
+		}
+
+		profile, err := eks.NewFargateProfile(ctx, "fargate-"+p.Name, &eks.FargateProfileArgs{
+			ClusterName:         eksCluster.Name,
+			FargateProfileName:  pulumi.String(p.Name),
+			PodExecutionRoleArn: podExecutionRole.Arn,
+			SubnetIds:           subnetIds,
+			Selectors:           selectors,
+			Tags:                pulumi.ToStringMap(tags),
+		}, append(opts, pulumi.DependsOn(previous))...)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, profile)
+		previous = []pulumi.Resource{profile}
+	}
+	return res, nil
+}
+
+// The EKS CoreDNS deployment is annotated to run on EC2 only, a one-off job removes the annotation and restarts it
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/fargate-getting-started.html#fargate-gs-coredns
+func patchCoreDnsForFargate(ctx *pulumi.Context, k8sProvider *providers.Provider) error {
+	labels := pulumi.StringMap{"app.kubernetes.io/name": pulumi.String(coreDnsPatchName)}
+	meta := &metav1.ObjectMetaArgs{
+		Name:      pulumi.String(coreDnsPatchName),
+		Namespace: pulumi.String("kube-system"),
+		Labels:    labels,
+	}
+
+	sa, err := corev1.NewServiceAccount(ctx, coreDnsPatchName, &corev1.ServiceAccountArgs{
+		Metadata: meta,
+	}, pulumi.Provider(k8sProvider))
+	if err != nil {
+		return err
+	}
+	role, err := rbacv1.NewRole(ctx, coreDnsPatchName, &rbacv1.RoleArgs{
+		Metadata: meta,
+		Rules: rbacv1.PolicyRuleArray{
+			rbacv1.PolicyRuleArgs{
+				ApiGroups:     pulumi.StringArray{pulumi.String("apps")},
+				Resources:     pulumi.StringArray{pulumi.String("deployments")},
+				ResourceNames: pulumi.StringArray{pulumi.String("coredns")},
+				Verbs:         pulumi.StringArray{pulumi.String("get"), pulumi.String("patch")},
+			},
+		},
+	}, pulumi.Provider(k8sProvider))
+	if err != nil {
+		return err
+	}
+	binding, err := rbacv1.NewRoleBinding(ctx, coreDnsPatchName, &rbacv1.RoleBindingArgs{
+		Metadata: meta,
+		RoleRef: rbacv1.RoleRefArgs{
+			ApiGroup: pulumi.String("rbac.authorization.k8s.io"),
+			Kind:     pulumi.String("Role"),
+			Name:     pulumi.String(coreDnsPatchName),
+		},
+		Subjects: rbacv1.SubjectArray{
+			rbacv1.SubjectArgs{
+				Kind:      pulumi.String("ServiceAccount"),
+				Name:      pulumi.String(coreDnsPatchName),
+				Namespace: pulumi.String("kube-system"),
+			},
+		},
+	}, pulumi.Provider(k8sProvider), pulumi.DependsOn([]pulumi.Resource{role}))
+	if err != nil {
+		return err
+	}
+
+	// The annotation may already be gone on a re-run, the restart is what matters then
+	script := `kubectl -n kube-system patch deployment coredns --type json ` +
+		`-p '[{"op":"remove","path":"/spec/template/metadata/annotations/eks.amazonaws.com~1compute-type"}]' || true
+kubectl -n kube-system rollout restart deployment coredns`
+
+	_, err = batchv1.NewJob(ctx, coreDnsPatchName, &batchv1.JobArgs{
+		Metadata: meta,
+		Spec: batchv1.JobSpecArgs{
+			BackoffLimit: pulumi.Int(4),
+			Template: corev1.PodTemplateSpecArgs{
+				Metadata: metav1.ObjectMetaArgs{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpecArgs{
+					ServiceAccountName: pulumi.String(coreDnsPatchName),
+					RestartPolicy:      pulumi.String("OnFailure"),
+					Containers: corev1.ContainerArray{
+						corev1.ContainerArgs{
+							Name:    pulumi.String("kubectl"),
+							Image:   pulumi.String(kubectlImage),
+							Command: pulumi.StringArray{pulumi.String("/bin/sh"), pulumi.String("-c"), pulumi.String(script)},
+						},
+					},
+				},
+			},
+		},
+	}, pulumi.Provider(k8sProvider), pulumi.DependsOn([]pulumi.Resource{sa, binding}))
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFargateProfiles(t *testing.T) {
+	config := &eksConfig{FargateProfiles: []FargateProfile{{Name: "apps", Selectors: []FargateSelector{{Namespace: "apps"}}}}}
+	assert.True(t, coreDnsOnFargate(config), "Without node groups CoreDNS has nowhere else to run")
+	assert.Equal(t, []FargateProfile{config.FargateProfiles[0], coreDnsFargateProfile}, fargateProfiles(config))
+
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		subnet, err := ec2.NewSubnet(ctx, "private", &ec2.SubnetArgs{VpcId: pulumi.String("vpc"), CidrBlock: pulumi.String("10.0.1.0/24")})
+		assert.NoError(t, err)
+		network := &networkResources{privSubnets: []*ec2.Subnet{subnet}}
+		cluster, err := eks.NewCluster(ctx, "eks-cluster", &eks.ClusterArgs{
+			Name:      pulumi.String("test"),
+			RoleArn:   pulumi.String("arn:aws:iam::123456789012:role/cluster"),
+			VpcConfig: &eks.ClusterVpcConfigArgs{SubnetIds: pulumi.StringArray{}},
+		})
+		assert.NoError(t, err)
+		role, err := setupFargatePodExecutionRole(ctx)
+		assert.NoError(t, err)
+
+		profiles, err := setupFargateProfiles(ctx, cluster, role, network, fargateProfiles(config), nil)
+		assert.NoError(t, err)
+		assert.Len(t, profiles, 2)
+
+		_, err = setupFargateProfiles(ctx, cluster, role, network, []FargateProfile{
+			{Name: "public", Selectors: []FargateSelector{{Namespace: "apps"}}, Subnets: "public"},
+		}, nil)
+		assert.Error(t, err, "Fargate pods never get a public IP")
+
+		provider, err := providers.NewProvider(ctx, "k8s", &providers.ProviderArgs{})
+		assert.NoError(t, err)
+		return patchCoreDnsForFargate(ctx, provider)
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	profile := m.inputs["fargate-coredns"]
+	assert.Equal(t, "test", profile["clusterName"].StringValue())
+	assert.Equal(t, "private_id", profile["subnetIds"].ArrayValue()[0].StringValue())
+	assert.Equal(t, "arn:aws:iam::123456789012:role/fargate-pod-execution-role", profile["podExecutionRoleArn"].StringValue())
+	selectors := profile["selectors"].ArrayValue()
+	assert.Len(t, selectors, 2)
+
+	// The job only runs if the coredns profile selects its pod, EC2 nodes may not exist
+	job := m.typed["kubernetes:batch/v1:Job::"+coreDnsPatchName]["spec"].ObjectValue()["template"].ObjectValue()
+	labels := job["metadata"].ObjectValue()["labels"].ObjectValue()
+	for k, v := range coreDnsFargateProfile.Selectors[1].Labels {
+		assert.Equal(t, v, labels[resource.PropertyKey(k)].StringValue())
+	}
+	assert.Equal(t, "kube-system", selectors[1].ObjectValue()["namespace"].StringValue())
+	container := job["spec"].ObjectValue()["containers"].ArrayValue()[0].ObjectValue()
+	assert.Equal(t, kubectlImage, container["image"].StringValue())
+	assert.Equal(t, coreDnsPatchName, job["spec"].ObjectValue()["serviceAccountName"].StringValue())
+}
@@ -1,56 +1,26 @@
 package main
 
 import (
-	"crypto/sha1"
-	"crypto/tls"
-	"crypto/x509"
-	"errors"
-	"fmt"
-	"net/url"
-
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"aws-go-eks/iampolicy"
 )
 
-//Create the KubeConfig Structure as per https://docs.aws.amazon.com/eks/latest/userguide/create-kubeconfig.html
-func generateKubeconfig(clusterEndpoint pulumi.StringOutput, certData pulumi.StringOutput, clusterName pulumi.StringOutput) pulumi.StringOutput {
-	return pulumi.Sprintf(`{
-        "apiVersion": "v1",
-        "clusters": [{
-            "cluster": {
-                "server": "%s",
-                "certificate-authority-data": "%s"
-            },
-            "name": "kubernetes",
-        }],
-        "contexts": [{
-            "context": {
-                "cluster": "kubernetes",
-                "user": "aws",
-            },
-            "name": "aws",
-        }],
-        "current-context": "aws",
-        "kind": "Config",
-        "users": [{
-            "name": "aws",
-            "user": {
-                "exec": {
-                    "apiVersion": "client.authentication.k8s.io/v1alpha1",
-                    "command": "aws",
-                    "args": [
-						"--region",
-						"eu-west-1",
-						"--profile",
-						"my-admin-account",
-						"eks",
-						"get-token",
-                        "--cluster-name",
-                        "%s",
-                    ],
-                },
-            },
-        }],
-    }`, clusterEndpoint, certData, clusterName)
+// Trust policy letting a Kubernetes service account assume a role through the cluster OIDC provider (IRSA)
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/associate-service-account-role.html
+func irsaAssumeRolePolicy(oidc *oidcProvider, namespace string, serviceAccounts []string) pulumi.StringOutput {
+	var subjects []string
+	for _, sa := range serviceAccounts {
+		subjects = append(subjects, "system:serviceaccount:"+namespace+":"+sa)
+	}
+	return iampolicy.Document{Statements: []iampolicy.Statement{{
+		Principals: []iampolicy.Principal{{Type: iampolicy.Federated, Identifiers: []pulumi.StringInput{oidc.arn}}},
+		Actions:    []string{"sts:AssumeRoleWithWebIdentity"},
+		Conditions: []iampolicy.Condition{
+			{Operator: iampolicy.StringEquals, Key: pulumi.Sprintf("%s:sub", oidc.issuer), Values: iampolicy.Strings(subjects...)},
+			{Operator: iampolicy.StringEquals, Key: pulumi.Sprintf("%s:aud", oidc.issuer), Values: iampolicy.Strings("sts.amazonaws.com")},
+		},
+	}}}.ToStringOutput()
 }
 
 func toPulumiStringArray(a []string) pulumi.StringArrayInput {
@@ -61,34 +31,21 @@ func toPulumiStringArray(a []string) pulumi.StringArrayInput {
 	return pulumi.StringArray(res)
 }
 
-func getThumbprint(oidc_issuer string) (string, error) {
-	url, err := url.Parse(oidc_issuer)
-	if err != nil {
-		return "", err
-	}
-
-	conn, err := tls.Dial("tcp", url.Hostname()+":443", &tls.Config{
-		InsecureSkipVerify: true,
-	})
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
+// Settings that default to true are *bool, nil when left out of the config
+func orTrue(b *bool) bool {
+	return b == nil || *b
+}
 
-	cs := conn.ConnectionState()
-	numCerts := len(cs.PeerCertificates)
-	var root *x509.Certificate
-	// Important! Get the last cert in the chain, which is the root CA.
-	if numCerts >= 1 {
-		root = cs.PeerCertificates[numCerts-1]
-	} else {
-		return "", errors.New("Error getting cert list from connection \n")
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
 	}
-	// print out the fingerprint
-	return fmt.Sprintf("%x", sha1.Sum(root.Raw)), nil
+	return false
 }
 
-func contains(s []string, e string) bool {
+func containsInt(s []int, e int) bool {
 	for _, a := range s {
 		if a == e {
 			return true
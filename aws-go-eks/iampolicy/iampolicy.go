@@ -0,0 +1,269 @@
+// Package iampolicy models IAM policy documents. Resources, principals and condition keys and values can be Pulumi
+// outputs, a document is rendered to JSON once all of them have resolved.
+package iampolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Docs: https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_elements_version.html
+const Version = "2012-10-17"
+
+const (
+	Allow = "Allow"
+	Deny  = "Deny"
+)
+
+// Principal types
+const (
+	AWS       = "AWS"
+	Service   = "Service"
+	Federated = "Federated"
+)
+
+// Condition operators used in this program
+// Docs: https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_elements_condition_operators.html
+const (
+	StringEquals = "StringEquals"
+	StringLike   = "StringLike"
+	ArnLike      = "ArnLike"
+	Null         = "Null"
+)
+
+type Document struct {
+	Statements []Statement
+}
+
+type Statement struct {
+	Sid string
+	// Allow when empty
+	Effect     string
+	Principals []Principal
+	Actions    []string
+	Resources  []pulumi.StringInput
+	Conditions []Condition
+	// Wildcard actions on every resource are rejected unless the statement allows them, e.g. in a key policy
+	// where "*" is the key itself
+	AllowWildcard bool
+}
+
+type Principal struct {
+	Type        string
+	Identifiers []pulumi.StringInput
+}
+
+type Condition struct {
+	Operator string
+	Key      pulumi.StringInput
+	Values   []pulumi.StringInput
+}
+
+// Shorthand for plain values
+func Strings(values ...string) []pulumi.StringInput {
+	res := make([]pulumi.StringInput, 0, len(values))
+	for _, v := range values {
+		res = append(res, pulumi.String(v))
+	}
+	return res
+}
+
+// Trust policy of a role assumed by AWS services
+func ServiceTrust(services ...string) Document {
+	return Document{Statements: []Statement{{
+		Principals: []Principal{{Type: Service, Identifiers: Strings(services...)}},
+		Actions:    []string{"sts:AssumeRole"},
+	}}}
+}
+
+// A single value is written as a string, like AWS does
+type stringList []string
+
+func (l stringList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// The document as it is sent to AWS
+type policy struct {
+	Version   string      `json:"Version"`
+	Statement []statement `json:"Statement"`
+}
+
+type statement struct {
+	Sid       string                           `json:"Sid,omitempty"`
+	Effect    string                           `json:"Effect"`
+	Principal map[string]stringList            `json:"Principal,omitempty"`
+	Action    stringList                       `json:"Action"`
+	Resource  stringList                       `json:"Resource,omitempty"`
+	Condition map[string]map[string]stringList `json:"Condition,omitempty"`
+
+	allowWildcard bool
+}
+
+// Walks every input of the document in a fixed order, value returns what each of them resolved to
+func (d Document) resolve(value func(pulumi.StringInput) string) policy {
+	values := func(inputs []pulumi.StringInput) stringList {
+		var res stringList
+		for _, in := range inputs {
+			res = append(res, value(in))
+		}
+		return res
+	}
+
+	p := policy{Version: Version}
+	for _, s := range d.Statements {
+		st := statement{
+			Sid:           s.Sid,
+			Effect:        s.Effect,
+			Action:        stringList(s.Actions),
+			Resource:      values(s.Resources),
+			allowWildcard: s.AllowWildcard,
+		}
+		if st.Effect == "" {
+			st.Effect = Allow
+		}
+		for _, principal := range s.Principals {
+			if st.Principal == nil {
+				st.Principal = map[string]stringList{}
+			}
+			st.Principal[principal.Type] = append(st.Principal[principal.Type], values(principal.Identifiers)...)
+		}
+		for _, c := range s.Conditions {
+			if st.Condition == nil {
+				st.Condition = map[string]map[string]stringList{}
+			}
+			if st.Condition[c.Operator] == nil {
+				st.Condition[c.Operator] = map[string]stringList{}
+			}
+			key := value(c.Key)
+			st.Condition[c.Operator][key] = append(st.Condition[c.Operator][key], values(c.Values)...)
+		}
+		p.Statement = append(p.Statement, st)
+	}
+	return p
+}
+
+// Rejects statements that allow wildcard actions on every resource
+func (p policy) lint() error {
+	for i, s := range p.Statement {
+		if s.Effect != Allow || s.allowWildcard || !containsString(s.Resource, "*") {
+			continue
+		}
+		for _, action := range s.Action {
+			if strings.Contains(action, "*") {
+				return fmt.Errorf("statement %d (%s) allows the wildcard action %s on every resource", i, s.Sid, action)
+			}
+		}
+	}
+	return nil
+}
+
+func (p policy) render() (string, error) {
+	if len(p.Statement) == 0 {
+		return "", fmt.Errorf("policy document has no statements")
+	}
+	if err := p.lint(); err != nil {
+		return "", err
+	}
+	for i, s := range p.Statement {
+		if s.Effect != Allow && s.Effect != Deny {
+			return "", fmt.Errorf("statement %d (%s) has the effect %q, use %s or %s", i, s.Sid, s.Effect, Allow, Deny)
+		}
+		if len(s.Action) == 0 {
+			return "", fmt.Errorf("statement %d (%s) has no actions", i, s.Sid)
+		}
+	}
+	out, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Resolves every input of the document and renders it, lint and validation errors fail the resource using it
+func (d Document) ToStringOutput() pulumi.StringOutput {
+	var inputs []interface{}
+	d.resolve(func(in pulumi.StringInput) string {
+		inputs = append(inputs, in)
+		return ""
+	})
+	return pulumi.All(inputs...).ApplyT(func(resolved []interface{}) (string, error) {
+		i := 0
+		return d.resolve(func(pulumi.StringInput) string {
+			v := resolved[i].(string)
+			i++
+			return v
+		}).render()
+	}).(pulumi.StringOutput)
+}
+
+// Parses a policy document kept as a file, e.g. one published by an upstream project
+func Parse(data []byte) (Document, error) {
+	var p policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Document{}, err
+	}
+	var d Document
+	for _, s := range p.Statement {
+		st := Statement{
+			Sid:       s.Sid,
+			Effect:    s.Effect,
+			Actions:   s.Action,
+			Resources: Strings(s.Resource...),
+		}
+		for _, t := range sortedKeys(s.Principal) {
+			st.Principals = append(st.Principals, Principal{Type: t, Identifiers: Strings(s.Principal[t]...)})
+		}
+		for _, op := range sortedOperators(s.Condition) {
+			for _, key := range sortedKeys(s.Condition[op]) {
+				st.Conditions = append(st.Conditions, Condition{Operator: op, Key: pulumi.String(key), Values: Strings(s.Condition[op][key]...)})
+			}
+		}
+		d.Statements = append(d.Statements, st)
+	}
+	return d, nil
+}
+
+// Map order is random, parsed documents keep a stable order so they don't show a diff on every run
+func sortedKeys(m map[string]stringList) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedOperators(m map[string]map[string]stringList) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
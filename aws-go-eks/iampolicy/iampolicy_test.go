@@ -0,0 +1,94 @@
+package iampolicy
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+type mocks int
+
+func (mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	return args.Name + "_id", args.Inputs, nil
+}
+
+func (mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	return args.Args, nil
+}
+
+func TestRender(t *testing.T) {
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		cluster := pulumi.String("demo").ToStringOutput()
+		doc := Document{Statements: []Statement{{
+			Actions:   []string{"autoscaling:SetDesiredCapacity"},
+			Resources: Strings("*"),
+			Conditions: []Condition{{
+				Operator: StringEquals,
+				Key:      pulumi.Sprintf("aws:ResourceTag/k8s.io/cluster-autoscaler/%s", cluster),
+				Values:   Strings("owned"),
+			}},
+		}}}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		doc.ToStringOutput().ApplyT(func(policy string) error {
+			assert.JSONEq(t, `{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Effect": "Allow",
+					"Action": "autoscaling:SetDesiredCapacity",
+					"Resource": "*",
+					"Condition": {"StringEquals": {"aws:ResourceTag/k8s.io/cluster-autoscaler/demo": "owned"}}
+				}]
+			}`, policy)
+			wg.Done()
+			return nil
+		})
+		wg.Wait()
+		return nil
+	}, pulumi.WithMocks("project", "stack", mocks(0)))
+	assert.NoError(t, err)
+}
+
+func TestLint(t *testing.T) {
+	wildcard := Statement{Actions: []string{"s3:*"}, Resources: Strings("*")}
+	_, err := Document{Statements: []Statement{wildcard}}.resolve(plain).render()
+	assert.Error(t, err)
+
+	wildcard.AllowWildcard = true
+	_, err = Document{Statements: []Statement{wildcard}}.resolve(plain).render()
+	assert.NoError(t, err)
+
+	// Wildcards scoped to a resource and denies are fine
+	_, err = Document{Statements: []Statement{
+		{Actions: []string{"s3:Get*"}, Resources: Strings("arn:aws:s3:::bucket/*")},
+		{Effect: Deny, Actions: []string{"*"}, Resources: Strings("*")},
+	}}.resolve(plain).render()
+	assert.NoError(t, err)
+
+	_, err = Document{Statements: []Statement{{Effect: "allow", Actions: []string{"s3:GetObject"}}}}.resolve(plain).render()
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	file, err := ioutil.ReadFile("../policies/alb_iam_policy.json")
+	assert.NoError(t, err)
+	doc, err := Parse(file)
+	assert.NoError(t, err)
+
+	policy, err := doc.resolve(plain).render()
+	assert.NoError(t, err, "The ALB controller policy should pass the linter")
+
+	// Single item lists are written as strings, otherwise the document survives a round trip unchanged
+	again, err := Parse([]byte(policy))
+	assert.NoError(t, err)
+	assert.Equal(t, doc, again)
+}
+
+func plain(in pulumi.StringInput) string {
+	return string(in.(pulumi.String))
+}
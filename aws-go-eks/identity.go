@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	corev1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/core/v1"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"aws-go-eks/iampolicy"
+)
+
+// How a service account gets AWS credentials, IRSA stays the default
+const (
+	identityIrsa        = "irsa"
+	identityPodIdentity = "podIdentity"
+	podIdentityAgent    = "eks-pod-identity-agent"
+)
+
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/pod-id-role.html
+var podIdentityTrustPolicy = iampolicy.Document{Statements: []iampolicy.Statement{{
+	Principals: []iampolicy.Principal{{Type: iampolicy.Service, Identifiers: iampolicy.Strings("pods.eks.amazonaws.com")}},
+	Actions:    []string{"sts:AssumeRole", "sts:TagSession"},
+}}}
+
+// What every workload role needs to know about the cluster, whichever identity it uses. The Kubernetes provider
+// is only needed to create service accounts and is nil before the cluster has compute.
+type clusterIdentity struct {
+	eksCluster  *eks.Cluster
+	oidc        *oidcProvider
+	k8sProvider *providers.Provider
+}
+
+type inlinePolicy struct {
+	name   string
+	policy iampolicy.Document
+}
+
+// A role shared by one or more service accounts of a namespace
+type serviceAccountRole struct {
+	namespace       string
+	serviceAccounts []string
+	mode            string
+	policyArns      []string
+	inlinePolicies  []inlinePolicy
+	// Creates the service accounts with the role annotation, for workloads that don't bring their own
+	createServiceAccounts bool
+}
+
+func identityMode(mode string) (string, error) {
+	switch mode {
+	case "", identityIrsa:
+		return identityIrsa, nil
+	case identityPodIdentity:
+		return identityPodIdentity, nil
+	}
+	return "", fmt.Errorf("unknown identity %q, use %s or %s", mode, identityIrsa, identityPodIdentity)
+}
+
+// Creates the role of the service accounts, trusting either the cluster OIDC provider or EKS Pod Identity, and the
+// associations for the latter. The returned annotations go on service accounts created elsewhere, e.g. by a chart;
+// Pod Identity needs none.
+func setupServiceAccountRole(ctx *pulumi.Context, name string, cluster *clusterIdentity, sa *serviceAccountRole) (*iam.Role, pulumi.Map, error) {
+	mode, err := identityMode(sa.mode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if sa.namespace == "" || len(sa.serviceAccounts) == 0 {
+		return nil, nil, fmt.Errorf("%s: a namespace and at least one service account are needed", name)
+	}
+	if sa.createServiceAccounts && cluster.k8sProvider == nil {
+		return nil, nil, fmt.Errorf("%s: service accounts can't be created before the cluster has compute", name)
+	}
+
+	roleArgs := &iam.RoleArgs{}
+	// An empty list would make the role detach policies attached elsewhere
+	if len(sa.policyArns) > 0 {
+		roleArgs.ManagedPolicyArns = toPulumiStringArray(sa.policyArns)
+	}
+	if mode == identityPodIdentity {
+		roleArgs.AssumeRolePolicy = podIdentityTrustPolicy.ToStringOutput()
+	} else {
+		roleArgs.AssumeRolePolicy = irsaAssumeRolePolicy(cluster.oidc, sa.namespace, sa.serviceAccounts)
+	}
+	if len(sa.inlinePolicies) > 0 {
+		policies := iam.RoleInlinePolicyArray{}
+		for _, p := range sa.inlinePolicies {
+			policies = append(policies, &iam.RoleInlinePolicyArgs{Name: pulumi.String(p.name), Policy: p.policy.ToStringOutput()})
+		}
+		roleArgs.InlinePolicies = policies
+	}
+	role, err := iam.NewRole(ctx, name, roleArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	annotations := pulumi.StringMap{}
+	if mode == identityIrsa {
+		annotations["eks.amazonaws.com/role-arn"] = role.Arn
+	}
+	for _, account := range sa.serviceAccounts {
+		// A role for a single service account keeps the resource names it had before roles could be shared
+		resourceName := name
+		if len(sa.serviceAccounts) > 1 {
+			resourceName = name + "-" + account
+		}
+		if mode == identityPodIdentity {
+			_, err = newEksPodIdentityAssociation(ctx, resourceName+"-pod-identity", &eksPodIdentityAssociationArgs{
+				ClusterName:    cluster.eksCluster.Name,
+				Namespace:      pulumi.String(sa.namespace),
+				ServiceAccount: pulumi.String(account),
+				RoleArn:        role.Arn,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if sa.createServiceAccounts {
+			_, err = corev1.NewServiceAccount(ctx, resourceName+"-sa", &corev1.ServiceAccountArgs{
+				Metadata: &metav1.ObjectMetaArgs{
+					Name:        pulumi.String(account),
+					Namespace:   pulumi.String(sa.namespace),
+					Annotations: annotations,
+				},
+			}, pulumi.Provider(cluster.k8sProvider))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	// Chart values take a plain map
+	values := pulumi.Map{}
+	for k, v := range annotations {
+		values[k] = v
+	}
+	return role, values, nil
+}
+
+func podIdentityUsed(eksConfig *eksConfig) bool {
+	for _, mode := range eksConfig.AddonIdentity {
+		if mode == identityPodIdentity {
+			return true
+		}
+	}
+	for _, addon := range eksConfig.ManagedAddons {
+		if addon.Identity == identityPodIdentity {
+			return true
+		}
+	}
+	for _, w := range eksConfig.Workloads {
+		if w.Identity == identityPodIdentity {
+			return true
+		}
+	}
+	return false
+}
+
+// The Pod Identity agent is a managed addon itself, it is added with the EKS defaults unless configured
+func withPodIdentityAgent(eksConfig *eksConfig) map[string]ManagedAddon {
+	addons := map[string]ManagedAddon{}
+	for name, addon := range eksConfig.ManagedAddons {
+		addons[name] = addon
+	}
+	if _, ok := addons[podIdentityAgent]; !ok && podIdentityUsed(eksConfig) {
+		addons[podIdentityAgent] = ManagedAddon{}
+	}
+	return addons
+}
+
+// Roles for the workloads of the cluster itself, their service accounts are managed outside this program unless
+// createServiceAccount is set
+func setupWorkloads(ctx *pulumi.Context, cluster *clusterIdentity, workloads []Workload) (pulumi.StringMap, error) {
+	roleArns := pulumi.StringMap{}
+	for _, w := range workloads {
+		if w.Name == "" || w.Namespace == "" || w.ServiceAccount == "" {
+			return nil, fmt.Errorf("workloads need a name, a namespace and a serviceAccount")
+		}
+		if _, ok := roleArns[w.Name]; ok {
+			return nil, fmt.Errorf("workload %s is defined more than once", w.Name)
+		}
+		role, _, err := setupServiceAccountRole(ctx, "workload-"+w.Name, cluster, &serviceAccountRole{
+			namespace:             w.Namespace,
+			serviceAccounts:       []string{w.ServiceAccount},
+			mode:                  w.Identity,
+			policyArns:            w.PolicyArns,
+			createServiceAccounts: w.CreateServiceAccount,
+		})
+		if err != nil {
+			return nil, err
+		}
+		roleArns[w.Name] = role.Arn
+	}
+	return roleArns, nil
+}
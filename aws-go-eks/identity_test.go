@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+
+	"aws-go-eks/iampolicy"
+)
+
+func TestPodIdentityAgent(t *testing.T) {
+	_, err := identityMode("kiam")
+	assert.Error(t, err)
+
+	// IRSA everywhere needs no agent
+	config := eksConfig{ManagedAddons: map[string]ManagedAddon{"vpc-cni": {}}}
+	assert.NotContains(t, withPodIdentityAgent(&config), podIdentityAgent)
+
+	config.Workloads = []Workload{{Name: "app", Namespace: "apps", ServiceAccount: "app", Identity: identityPodIdentity}}
+	addons := withPodIdentityAgent(&config)
+	assert.Contains(t, addons, podIdentityAgent)
+	assert.Contains(t, addons, "vpc-cni")
+	assert.NotContains(t, config.ManagedAddons, podIdentityAgent, "the config itself is left alone")
+}
+
+func TestServiceAccountRole(t *testing.T) {
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		provider, err := providers.NewProvider(ctx, "k8s", &providers.ProviderArgs{})
+		assert.NoError(t, err)
+		cluster := &clusterIdentity{
+			oidc: &oidcProvider{
+				arn:    pulumi.String("arn:aws:iam::123456789012:oidc-provider/oidc.example.com/id/1").ToStringOutput(),
+				issuer: pulumi.String("oidc.example.com/id/1").ToStringOutput(),
+			},
+			k8sProvider: provider,
+		}
+
+		role, annotations, err := setupServiceAccountRole(ctx, "reports", cluster, &serviceAccountRole{
+			namespace:       "apps",
+			serviceAccounts: []string{"reports", "reports-worker"},
+			policyArns:      []string{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"},
+			inlinePolicies: []inlinePolicy{{"queue", iampolicy.Document{Statements: []iampolicy.Statement{{
+				Actions:   []string{"sqs:ReceiveMessage"},
+				Resources: iampolicy.Strings("arn:aws:sqs:eu-west-1:123456789012:reports"),
+			}}}}},
+			createServiceAccounts: true,
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, annotations, "eks.amazonaws.com/role-arn")
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		role.AssumeRolePolicy.ApplyT(func(policy string) error {
+			var doc struct {
+				Statement []struct {
+					Principal map[string]string
+					Condition map[string]map[string]interface{}
+				}
+			}
+			assert.NoError(t, json.Unmarshal([]byte(policy), &doc))
+			assert.Equal(t, "arn:aws:iam::123456789012:oidc-provider/oidc.example.com/id/1", doc.Statement[0].Principal["Federated"])
+			conditions := doc.Statement[0].Condition["StringEquals"]
+			assert.Equal(t, "sts.amazonaws.com", conditions["oidc.example.com/id/1:aud"])
+			assert.Equal(t, []interface{}{
+				"system:serviceaccount:apps:reports",
+				"system:serviceaccount:apps:reports-worker",
+			}, conditions["oidc.example.com/id/1:sub"])
+			wg.Done()
+			return nil
+		})
+		wg.Wait()
+
+		// Pod Identity trusts EKS, each service account is associated with the role instead of annotated
+		cluster.eksCluster, err = eks.NewCluster(ctx, "eks-cluster", &eks.ClusterArgs{
+			Name:      pulumi.String("test"),
+			RoleArn:   pulumi.String("arn:aws:iam::123456789012:role/cluster"),
+			VpcConfig: &eks.ClusterVpcConfigArgs{SubnetIds: pulumi.StringArray{}},
+		})
+		assert.NoError(t, err)
+		_, annotations, err = setupServiceAccountRole(ctx, "exports", cluster, &serviceAccountRole{
+			namespace:       "apps",
+			serviceAccounts: []string{"exports", "exports-worker"},
+			mode:            identityPodIdentity,
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, annotations, "Pod Identity needs no annotation")
+
+		// A single service account keeps the resource names it had before roles could be shared
+		_, _, err = setupServiceAccountRole(ctx, "single", cluster, &serviceAccountRole{
+			namespace:             "apps",
+			serviceAccounts:       []string{"single"},
+			createServiceAccounts: true,
+		})
+		assert.NoError(t, err)
+
+		// Nothing to create the service accounts with before the cluster has compute
+		cluster.k8sProvider = nil
+		_, _, err = setupServiceAccountRole(ctx, "early", cluster, &serviceAccountRole{
+			namespace:             "apps",
+			serviceAccounts:       []string{"early"},
+			createServiceAccounts: true,
+		})
+		assert.Error(t, err)
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	for _, account := range []string{"exports", "exports-worker"} {
+		association := m.inputs["exports-"+account+"-pod-identity"]
+		assert.Equal(t, "test", association["clusterName"].StringValue())
+		assert.Equal(t, "apps", association["namespace"].StringValue())
+		assert.Equal(t, account, association["serviceAccount"].StringValue())
+	}
+	assert.Contains(t, m.inputs["exports"]["assumeRolePolicy"].StringValue(), "pods.eks.amazonaws.com")
+
+	assert.Contains(t, m.inputs, "single-sa")
+	assert.NotContains(t, m.inputs, "single-single-sa")
+	var doc struct {
+		Statement []struct {
+			Condition map[string]map[string]interface{}
+		}
+	}
+	assert.NoError(t, json.Unmarshal([]byte(m.inputs["single"]["assumeRolePolicy"].StringValue()), &doc))
+	assert.Equal(t, "system:serviceaccount:apps:single", doc.Statement[0].Condition["StringEquals"]["oidc.example.com/id/1:sub"],
+		"A single subject should be a string, not a list")
+}
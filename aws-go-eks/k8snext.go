@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Helm releases and server-side apply only exist in newer releases of the Kubernetes provider than the v3 SDK we build
+// against. They go through a provider pinned to this version, the engine runs that plugin next to the old one.
+const k8sNextVersion = "3.30.2"
+
+// Docs: https://www.pulumi.com/registry/packages/kubernetes/api-docs/provider/#inputs
+type k8sNextProviderArgs struct {
+	// Creating an object that already exists updates it instead of failing, see setupAwsAuth
+	EnableServerSideApply pulumi.BoolPtrInput
+	Kubeconfig            pulumi.StringPtrInput
+}
+
+type k8sNextProviderInputs struct {
+	EnableServerSideApply *bool   `pulumi:"enableServerSideApply"`
+	Kubeconfig            *string `pulumi:"kubeconfig"`
+}
+
+func (k8sNextProviderArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*k8sNextProviderInputs)(nil)).Elem()
+}
+
+// A second provider for the same cluster running the newer plugin, resources registered by token go through it
+func newK8sNextProvider(ctx *pulumi.Context, name string, args *k8sNextProviderArgs, opts ...pulumi.ResourceOption) (*providers.Provider, error) {
+	var resource providers.Provider
+	opts = append(opts, pulumi.Version(k8sNextVersion))
+	err := ctx.RegisterResource("pulumi:providers:kubernetes", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// Resource: Helm Release
+// Purpose: Installs a chart with Helm itself, so hooks run, CRDs are upgraded and `helm list` shows the release.
+// Docs: https://www.pulumi.com/registry/packages/kubernetes/api-docs/helm/v3/release/
+type helmRelease struct {
+	pulumi.CustomResourceState
+
+	Name      pulumi.StringOutput `pulumi:"name"`
+	Namespace pulumi.StringOutput `pulumi:"namespace"`
+}
+
+// Docs: https://www.pulumi.com/registry/packages/kubernetes/api-docs/helm/v3/release/#inputs
+type helmReleaseArgs struct {
+	Atomic          pulumi.BoolInput
+	Chart           pulumi.StringInput
+	CleanupOnFail   pulumi.BoolInput
+	CreateNamespace pulumi.BoolInput
+	Name            pulumi.StringInput
+	Namespace       pulumi.StringInput
+	RepositoryOpts  *helmReleaseRepositoryOptsArgs
+	SkipAwait       pulumi.BoolInput
+	SkipCrds        pulumi.BoolInput
+	Timeout         pulumi.IntInput
+	Values          pulumi.MapInput
+	Version         pulumi.StringInput
+}
+
+type helmReleaseInputs struct {
+	Atomic          bool                       `pulumi:"atomic"`
+	Chart           string                     `pulumi:"chart"`
+	CleanupOnFail   bool                       `pulumi:"cleanupOnFail"`
+	CreateNamespace bool                       `pulumi:"createNamespace"`
+	Name            string                     `pulumi:"name"`
+	Namespace       string                     `pulumi:"namespace"`
+	RepositoryOpts  *helmReleaseRepositoryOpts `pulumi:"repositoryOpts"`
+	SkipAwait       bool                       `pulumi:"skipAwait"`
+	SkipCrds        bool                       `pulumi:"skipCrds"`
+	Timeout         int                        `pulumi:"timeout"`
+	Values          map[string]interface{}     `pulumi:"values"`
+	Version         string                     `pulumi:"version"`
+}
+
+func (helmReleaseArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*helmReleaseInputs)(nil)).Elem()
+}
+
+type helmReleaseRepositoryOptsArgs struct {
+	Repo pulumi.StringInput
+}
+
+type helmReleaseRepositoryOpts struct {
+	Repo string `pulumi:"repo"`
+}
+
+func (helmReleaseRepositoryOptsArgs) ElementType() reflect.Type {
+	return reflect.TypeOf((*helmReleaseRepositoryOpts)(nil)).Elem()
+}
+
+func newHelmRelease(ctx *pulumi.Context, name string, args *helmReleaseArgs, provider *providers.Provider, opts ...pulumi.ResourceOption) (*helmRelease, error) {
+	var resource helmRelease
+	opts = append(opts, pulumi.Provider(provider), pulumi.Version(k8sNextVersion))
+	err := ctx.RegisterResource("kubernetes:helm.sh/v3:Release", name, args, &resource, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/sqs"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/apiextensions"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	"aws-go-eks/iampolicy"
+)
+
+const (
+	karpenterNamespace      = "kube-system"
+	karpenterServiceAccount = "karpenter"
+	karpenterDiscoveryTag   = "karpenter.sh/discovery"
+)
+
+// EC2 and health events Karpenter reacts to by draining nodes ahead of time
+// Docs: https://karpenter.sh/docs/concepts/disruption/#interruption
+var karpenterInterruptionEvents = map[string]map[string]interface{}{
+	"scheduled-change":  {"source": []string{"aws.health"}, "detail-type": []string{"AWS Health Event"}},
+	"spot-interruption": {"source": []string{"aws.ec2"}, "detail-type": []string{"EC2 Spot Instance Interruption Warning"}},
+	"rebalance":         {"source": []string{"aws.ec2"}, "detail-type": []string{"EC2 Instance Rebalance Recommendation"}},
+	"state-change":      {"source": []string{"aws.ec2"}, "detail-type": []string{"EC2 Instance State-change Notification"}},
+}
+
+func karpenterEnabled(eksConfig *eksConfig) bool {
+	return addonEnabled(eksConfig, "karpenter")
+}
+
+// Tags that let Karpenter discover the subnets and security groups of the cluster
+func karpenterDiscoveryTags(settings *stackSettings, eksConfig *eksConfig) map[string]string {
+	if !karpenterEnabled(eksConfig) {
+		return nil
+	}
+	return map[string]string{karpenterDiscoveryTag: eksClusterName(settings)}
+}
+
+type karpenterAddon struct{}
+
+func (karpenterAddon) Name() string          { return "karpenter" }
+func (karpenterAddon) After() []string       { return []string{"loadBalancerController"} }
+func (karpenterAddon) UsesAwsIdentity() bool { return true }
+
+func (karpenterAddon) Validate(eksConfig *eksConfig) error {
+	if addonEnabled(eksConfig, "clusterAutoscaller") {
+		return fmt.Errorf("karpenter and clusterAutoscaller can't be enabled together")
+	}
+	return nil
+}
+
+// karpenter.version is still honoured, addons.karpenter.version wins over it
+func (karpenterAddon) Chart(eksConfig *eksConfig) addonChart {
+	version := eksConfig.Karpenter.Version
+	if version == "" {
+		version = "0.37.0"
+	}
+	return addonChart{
+		Chart:     "oci://public.ecr.aws/karpenter/karpenter",
+		Version:   version,
+		Namespace: karpenterNamespace,
+	}
+}
+
+func (karpenterAddon) Deploy(ctx *pulumi.Context, env *addonEnv, chart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	return setupKarpenter(ctx, env.eksResources, env.eksConfig, env.cluster, chart, opts...)
+}
+
+func setupKarpenter(ctx *pulumi.Context, eksResources *eksResources, eksConfig *eksConfig, cluster *clusterIdentity, karpenterChart *addonChart, opts ...pulumi.ResourceOption) (pulumi.Resource, error) {
+	clusterName := eksResources.clusterName
+
+	// Resource: SQS Queue
+	// Purpose: Receives interruption events so Karpenter can cordon and drain nodes before they go away.
+	// Docs: https://karpenter.sh/docs/concepts/disruption/#interruption
+	queue, err := sqs.NewQueue(ctx, "karpenter-interruption-queue", &sqs.QueueArgs{
+		Name:                    pulumi.String(limitName(clusterName+"-karpenter", maxQueueNameLength)),
+		MessageRetentionSeconds: pulumi.Int(300),
+		SqsManagedSseEnabled:    pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queuePolicy := iampolicy.Document{Statements: []iampolicy.Statement{{
+		Principals: []iampolicy.Principal{{Type: iampolicy.Service, Identifiers: iampolicy.Strings("events.amazonaws.com", "sqs.amazonaws.com")}},
+		Actions:    []string{"sqs:SendMessage"},
+		Resources:  []pulumi.StringInput{queue.Arn},
+	}}}
+	_, err = sqs.NewQueuePolicy(ctx, "karpenter-interruption-queue-policy", &sqs.QueuePolicyArgs{
+		QueueUrl: queue.Url,
+		Policy:   queuePolicy.ToStringOutput(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, pattern := range karpenterInterruptionEvents {
+		eventPattern, err := json.Marshal(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rule, err := cloudwatch.NewEventRule(ctx, "karpenter-"+name, &cloudwatch.EventRuleArgs{
+			EventPattern: pulumi.String(eventPattern),
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = cloudwatch.NewEventTarget(ctx, "karpenter-"+name, &cloudwatch.EventTargetArgs{
+			Rule: rule.Name,
+			Arn:  queue.Arn,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Karpenter launches plain EC2 instances, they join with the node group role through an instance profile
+	instanceProfile, err := iam.NewInstanceProfile(ctx, "karpenter-node-instance-profile", &iam.InstanceProfileArgs{
+		Role: eksResources.nodeRole.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Docs: https://karpenter.sh/docs/reference/cloudformation/#karpentercontrollerpolicy
+	controllerPolicy := iampolicy.Document{Statements: []iampolicy.Statement{
+		{
+			Sid: "AllowScopedEC2Actions",
+			Actions: []string{
+				"ec2:CreateFleet",
+				"ec2:CreateLaunchTemplate",
+				"ec2:CreateTags",
+				"ec2:DeleteLaunchTemplate",
+				"ec2:RunInstances",
+				"ec2:TerminateInstances",
+				"ec2:DescribeAvailabilityZones",
+				"ec2:DescribeImages",
+				"ec2:DescribeInstances",
+				"ec2:DescribeInstanceTypeOfferings",
+				"ec2:DescribeInstanceTypes",
+				"ec2:DescribeLaunchTemplates",
+				"ec2:DescribeSecurityGroups",
+				"ec2:DescribeSpotPriceHistory",
+				"ec2:DescribeSubnets",
+				"pricing:GetProducts",
+				"ssm:GetParameter",
+			},
+			Resources: iampolicy.Strings("*"),
+		},
+		{
+			Sid: "AllowInterruptionQueueActions",
+			Actions: []string{
+				"sqs:DeleteMessage",
+				"sqs:GetQueueUrl",
+				"sqs:ReceiveMessage",
+			},
+			Resources: []pulumi.StringInput{queue.Arn},
+		},
+		{
+			Sid:       "AllowPassingInstanceRole",
+			Actions:   []string{"iam:PassRole"},
+			Resources: []pulumi.StringInput{eksResources.nodeRole.Arn},
+		},
+		{
+			Sid:       "AllowAPIServerEndpointDiscovery",
+			Actions:   []string{"eks:DescribeCluster"},
+			Resources: []pulumi.StringInput{eksResources.eksCluster.Arn},
+		},
+	}}
+
+	_, annotations, err := setupServiceAccountRole(ctx, "karpenter-controller-role", cluster, &serviceAccountRole{
+		namespace:       karpenterChart.Namespace,
+		serviceAccounts: []string{karpenterServiceAccount},
+		mode:            eksConfig.AddonIdentity["karpenter"],
+		inlinePolicies:  []inlinePolicy{{"policy-for-karpenter", controllerPolicy}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The chart keeps the controller off the nodes it manages, that expression has to survive our override
+	affinity, err := addonAffinity(eksConfig, pulumi.Map{
+		"key":      pulumi.String("karpenter.sh/nodepool"),
+		"operator": pulumi.String("DoesNotExist"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	chart, err := karpenterChart.install(ctx, eksResources, "karpenter", pulumi.Map{
+		"affinity":    affinity,
+		"tolerations": addonTolerations(),
+		"settings": pulumi.Map{
+			"clusterName":       eksResources.eksCluster.Name,
+			"clusterEndpoint":   eksResources.eksCluster.Endpoint,
+			"interruptionQueue": queue.Name,
+		},
+		"serviceAccount": pulumi.Map{
+			"name":        pulumi.String(karpenterServiceAccount),
+			"annotations": annotations,
+		},
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pool := range eksConfig.Karpenter.NodePools {
+		err = setupKarpenterNodePool(ctx, eksResources, &pool, instanceProfile, chart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chart, nil
+}
+
+// Every pool gets its own EC2NodeClass, so the AMI family can differ between pools
+// Docs: https://karpenter.sh/docs/concepts/nodepools/
+func setupKarpenterNodePool(ctx *pulumi.Context, eksResources *eksResources, pool *KarpenterNodePool, instanceProfile *iam.InstanceProfile, chart pulumi.Resource) error {
+	if pool.Name == "" {
+		return fmt.Errorf("every karpenter node pool needs a name")
+	}
+	amiFamily := pool.AmiFamily
+	if amiFamily == "" {
+		amiFamily = "AL2"
+	}
+	discovery := []map[string]interface{}{
+		{"tags": map[string]interface{}{karpenterDiscoveryTag: eksResources.clusterName}},
+	}
+
+	nodeClass, err := apiextensions.NewCustomResource(ctx, "karpenter-nodeclass-"+pool.Name, &apiextensions.CustomResourceArgs{
+		ApiVersion: pulumi.String("karpenter.k8s.aws/v1beta1"),
+		Kind:       pulumi.String("EC2NodeClass"),
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String(pool.Name),
+		},
+		OtherFields: map[string]interface{}{
+			"spec": pulumi.Map{
+				"amiFamily":                  pulumi.String(amiFamily),
+				"instanceProfile":            instanceProfile.Name,
+				"subnetSelectorTerms":        pulumi.ToMapArray(discovery),
+				"securityGroupSelectorTerms": pulumi.ToMapArray(discovery),
+			},
+		},
+	}, pulumi.Provider(eksResources.k8sProvider), pulumi.DependsOn([]pulumi.Resource{chart}))
+	if err != nil {
+		return err
+	}
+
+	requirements := []map[string]interface{}{}
+	addRequirement := func(key string, values []string) {
+		if len(values) > 0 {
+			requirements = append(requirements, map[string]interface{}{"key": key, "operator": "In", "values": values})
+		}
+	}
+	addRequirement("karpenter.sh/capacity-type", pool.CapacityTypes)
+	addRequirement("kubernetes.io/arch", pool.Architectures)
+	addRequirement("node.kubernetes.io/instance-type", pool.InstanceTypes)
+
+	taints := []map[string]interface{}{}
+	for _, t := range pool.Taints {
+		effect, ok := taintEffects[t.Effect]
+		if !ok {
+			return fmt.Errorf("karpenter node pool %s: invalid taint effect %q for %s", pool.Name, t.Effect, t.Key)
+		}
+		taints = append(taints, map[string]interface{}{"key": t.Key, "value": t.Value, "effect": effect})
+	}
+
+	consolidationPolicy := pool.ConsolidationPolicy
+	if consolidationPolicy == "" {
+		consolidationPolicy = "WhenUnderutilized"
+	}
+	spec := map[string]interface{}{
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": pool.Labels,
+			},
+			"spec": map[string]interface{}{
+				"nodeClassRef": map[string]interface{}{
+					"apiVersion": "karpenter.k8s.aws/v1beta1",
+					"kind":       "EC2NodeClass",
+					"name":       pool.Name,
+				},
+				"requirements": requirements,
+				"taints":       taints,
+			},
+		},
+		"disruption": map[string]interface{}{
+			"consolidationPolicy": consolidationPolicy,
+		},
+	}
+	if len(pool.Limits) > 0 {
+		spec["limits"] = pool.Limits
+	}
+
+	_, err = apiextensions.NewCustomResource(ctx, "karpenter-nodepool-"+pool.Name, &apiextensions.CustomResourceArgs{
+		ApiVersion: pulumi.String("karpenter.sh/v1beta1"),
+		Kind:       pulumi.String("NodePool"),
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String(pool.Name),
+		},
+		OtherFields: map[string]interface{}{
+			"spec": pulumi.ToMap(spec),
+		},
+	}, pulumi.Provider(eksResources.k8sProvider), pulumi.DependsOn([]pulumi.Resource{nodeClass}))
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v3/go/kubernetes/providers"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupKarpenter(t *testing.T) {
+	settings := &stackSettings{NamePrefix: "dev"}
+	config := &eksConfig{
+		Addons: AddonsConfig{"karpenter": {Install: installRelease}},
+		Karpenter: Karpenter{NodePools: []KarpenterNodePool{{
+			Name:          "default",
+			CapacityTypes: []string{"spot"},
+			Architectures: []string{"arm64"},
+			Taints:        []Taint{{Key: "dedicated", Value: "batch", Effect: "NO_SCHEDULE"}},
+			Limits:        map[string]string{"cpu": "100"},
+		}}},
+	}
+	chart, err := resolveAddonChart(karpenterAddon{}, config)
+	assert.NoError(t, err)
+
+	m := &recordingMocks{}
+	err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+		cluster, err := eks.NewCluster(ctx, "eks-cluster", &eks.ClusterArgs{
+			Name:      pulumi.String("test"),
+			RoleArn:   pulumi.String("arn:aws:iam::123456789012:role/cluster"),
+			VpcConfig: &eks.ClusterVpcConfigArgs{SubnetIds: pulumi.StringArray{}},
+		})
+		assert.NoError(t, err)
+		nodeRole, err := iam.NewRole(ctx, "node", &iam.RoleArgs{AssumeRolePolicy: pulumi.String("{}")})
+		assert.NoError(t, err)
+		provider, err := providers.NewProvider(ctx, "k8s", &providers.ProviderArgs{})
+		assert.NoError(t, err)
+		eksResources := &eksResources{
+			k8sProvider:  provider,
+			helmProvider: provider,
+			eksCluster:   cluster,
+			clusterName:  eksClusterName(settings),
+			nodeRole:     nodeRole,
+			settings:     settings,
+		}
+		identity := &clusterIdentity{
+			eksCluster: cluster,
+			oidc: &oidcProvider{
+				arn:    pulumi.String("arn:aws:iam::123456789012:oidc-provider/oidc.example.com/id/1").ToStringOutput(),
+				issuer: pulumi.String("oidc.example.com/id/1").ToStringOutput(),
+			},
+		}
+		_, err = setupKarpenter(ctx, eksResources, config, identity, chart)
+		assert.NoError(t, err)
+
+		bad := &KarpenterNodePool{Name: "bad", Taints: []Taint{{Key: "dedicated", Effect: "NoSchedule"}}}
+		profile, err := iam.NewInstanceProfile(ctx, "profile", &iam.InstanceProfileArgs{Role: nodeRole.Name})
+		assert.NoError(t, err)
+		assert.Error(t, setupKarpenterNodePool(ctx, eksResources, bad, profile, profile), "Taint effects use the node group spelling")
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "dev-eks-karpenter", m.inputs["karpenter-interruption-queue"]["name"].StringValue())
+	for name := range karpenterInterruptionEvents {
+		assert.Contains(t, m.typed["aws:cloudwatch/eventRule:EventRule::karpenter-"+name]["eventPattern"].StringValue(), "source")
+		assert.Contains(t, m.typed, "aws:cloudwatch/eventTarget:EventTarget::karpenter-"+name, "Every rule should send to the queue")
+	}
+	values := m.inputs["karpenter"]["values"].ObjectValue()
+	assert.Equal(t, "test", values["settings"].ObjectValue()["clusterName"].StringValue())
+	assert.Equal(t, "dev-eks-karpenter", values["settings"].ObjectValue()["interruptionQueue"].StringValue())
+	assert.Equal(t, "arn:aws:iam::123456789012:role/karpenter-controller-role",
+		values["serviceAccount"].ObjectValue()["annotations"].ObjectValue()["eks.amazonaws.com/role-arn"].StringValue())
+
+	// Karpenter finds its subnets and security groups by the tag the network and the cluster are given
+	discovery := karpenterDiscoveryTags(settings, config)
+	assert.Equal(t, eksClusterName(settings), discovery[karpenterDiscoveryTag])
+	nodeClass := m.inputs["karpenter-nodeclass-default"]["spec"].ObjectValue()
+	assert.Equal(t, "AL2", nodeClass["amiFamily"].StringValue())
+	for _, terms := range []string{"subnetSelectorTerms", "securityGroupSelectorTerms"} {
+		tags := nodeClass[resource.PropertyKey(terms)].ArrayValue()[0].ObjectValue()["tags"].ObjectValue()
+		assert.Equal(t, discovery[karpenterDiscoveryTag], tags[karpenterDiscoveryTag].StringValue(), terms)
+	}
+
+	pool := m.inputs["karpenter-nodepool-default"]["spec"].ObjectValue()
+	template := pool["template"].ObjectValue()["spec"].ObjectValue()
+	requirements := template["requirements"].ArrayValue()
+	assert.Len(t, requirements, 2, "Only the configured requirements")
+	assert.Equal(t, "karpenter.sh/capacity-type", requirements[0].ObjectValue()["key"].StringValue())
+	assert.Equal(t, "arm64", requirements[1].ObjectValue()["values"].ArrayValue()[0].StringValue())
+	assert.Equal(t, "NoSchedule", template["taints"].ArrayValue()[0].ObjectValue()["effect"].StringValue())
+	assert.Equal(t, "default", template["nodeClassRef"].ObjectValue()["name"].StringValue())
+	assert.Equal(t, "WhenUnderutilized", pool["disruption"].ObjectValue()["consolidationPolicy"].StringValue())
+	assert.Equal(t, "100", pool["limits"].ObjectValue()["cpu"].StringValue())
+}
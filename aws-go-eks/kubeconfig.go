@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"gopkg.in/yaml.v2"
+)
+
+// v1alpha1 was removed in kubectl 1.24, v1beta1 is understood by every client since 1.11
+const execApiVersion = "client.authentication.k8s.io/v1beta1"
+
+var kubeconfigAuthenticators = []string{"aws", "aws-iam-authenticator"}
+var kubeconfigFormats = []string{"json", "yaml"}
+
+// Role names end up in output keys and file names, anything else IAM allows in a role path or name becomes a -
+var kubeconfigRoleNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+const defaultKubeconfigDir = "kubeconfig"
+
+// Typed kubeconfig, field names follow k8s.io/client-go/tools/clientcmd/api/v1
+type kubeconfig struct {
+	ApiVersion     string          `json:"apiVersion" yaml:"apiVersion"`
+	Kind           string          `json:"kind" yaml:"kind"`
+	Clusters       []namedCluster  `json:"clusters" yaml:"clusters"`
+	Contexts       []namedContext  `json:"contexts" yaml:"contexts"`
+	CurrentContext string          `json:"current-context" yaml:"current-context"`
+	Users          []namedAuthInfo `json:"users" yaml:"users"`
+}
+
+type namedCluster struct {
+	Name    string            `json:"name" yaml:"name"`
+	Cluster kubeconfigCluster `json:"cluster" yaml:"cluster"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `json:"server" yaml:"server"`
+	CertificateAuthorityData string `json:"certificate-authority-data" yaml:"certificate-authority-data"`
+}
+
+type namedContext struct {
+	Name    string            `json:"name" yaml:"name"`
+	Context kubeconfigContext `json:"context" yaml:"context"`
+}
+
+type kubeconfigContext struct {
+	Cluster string `json:"cluster" yaml:"cluster"`
+	User    string `json:"user" yaml:"user"`
+}
+
+type namedAuthInfo struct {
+	Name string         `json:"name" yaml:"name"`
+	User kubeconfigUser `json:"user" yaml:"user"`
+}
+
+type kubeconfigUser struct {
+	Exec execConfig `json:"exec" yaml:"exec"`
+}
+
+type execConfig struct {
+	ApiVersion string       `json:"apiVersion" yaml:"apiVersion"`
+	Command    string       `json:"command" yaml:"command"`
+	Args       []string     `json:"args" yaml:"args"`
+	Env        []execEnvVar `json:"env,omitempty" yaml:"env,omitempty"`
+}
+
+type execEnvVar struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// How the kubeconfig users authenticate, resolved once from the aws provider and the eks.kubeconfig config
+type kubeconfigAuth struct {
+	Region        string
+	Profile       string
+	RoleArn       string
+	Authenticator string
+	Env           map[string]string
+	Format        string
+}
+
+// Region and profile come from the aws provider config, so the kubeconfig talks to the cluster the way Pulumi does
+func newKubeconfigAuth(ctx *pulumi.Context, cfg *Kubeconfig) (*kubeconfigAuth, error) {
+	awsConf := config.New(ctx, "aws")
+	auth := &kubeconfigAuth{
+		Region:        awsConf.Get("region"),
+		Profile:       awsConf.Get("profile"),
+		RoleArn:       cfg.RoleArn,
+		Authenticator: cfg.Authenticator,
+		Env:           cfg.Env,
+		Format:        cfg.Format,
+	}
+	if auth.Authenticator == "" {
+		auth.Authenticator = "aws"
+	}
+	if auth.Format == "" {
+		auth.Format = "json"
+	}
+	if !contains(kubeconfigAuthenticators, auth.Authenticator) {
+		return nil, fmt.Errorf("kubeconfig authenticator %q is not one of %v", auth.Authenticator, kubeconfigAuthenticators)
+	}
+	if !contains(kubeconfigFormats, auth.Format) {
+		return nil, fmt.Errorf("kubeconfig format %q is not one of %v", auth.Format, kubeconfigFormats)
+	}
+	return auth, nil
+}
+
+// Same authentication, but the token is issued for another role
+func (a *kubeconfigAuth) withRole(roleArn string) *kubeconfigAuth {
+	role := *a
+	role.RoleArn = roleArn
+	return &role
+}
+
+// Token command for the exec plugin, the aws cli takes the profile as a flag, aws-iam-authenticator reads it from the env
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/create-kubeconfig.html
+func (a *kubeconfigAuth) exec(clusterName string) execConfig {
+	env := map[string]string{}
+	for k, v := range a.Env {
+		env[k] = v
+	}
+
+	var args []string
+	if a.Authenticator == "aws-iam-authenticator" {
+		args = []string{"token", "-i", clusterName}
+		if a.RoleArn != "" {
+			args = append(args, "-r", a.RoleArn)
+		}
+		if a.Region != "" {
+			env["AWS_REGION"] = a.Region
+		}
+		if a.Profile != "" {
+			env["AWS_PROFILE"] = a.Profile
+		}
+	} else {
+		if a.Region != "" {
+			args = append(args, "--region", a.Region)
+		}
+		if a.Profile != "" {
+			args = append(args, "--profile", a.Profile)
+		}
+		args = append(args, "eks", "get-token", "--cluster-name", clusterName)
+		if a.RoleArn != "" {
+			args = append(args, "--role-arn", a.RoleArn)
+		}
+	}
+
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var envVars []execEnvVar
+	for _, k := range names {
+		envVars = append(envVars, execEnvVar{Name: k, Value: env[k]})
+	}
+
+	return execConfig{
+		ApiVersion: execApiVersion,
+		Command:    a.Authenticator,
+		Args:       args,
+		Env:        envVars,
+	}
+}
+
+// A single cluster, context and user, all named after the cluster so the file merges cleanly with others
+func buildKubeconfig(endpoint string, certData string, clusterName string, auth *kubeconfigAuth) kubeconfig {
+	return kubeconfig{
+		ApiVersion: "v1",
+		Kind:       "Config",
+		Clusters: []namedCluster{{
+			Name:    clusterName,
+			Cluster: kubeconfigCluster{Server: endpoint, CertificateAuthorityData: certData},
+		}},
+		Contexts: []namedContext{{
+			Name:    clusterName,
+			Context: kubeconfigContext{Cluster: clusterName, User: clusterName},
+		}},
+		CurrentContext: clusterName,
+		Users: []namedAuthInfo{{
+			Name: clusterName,
+			User: kubeconfigUser{Exec: auth.exec(clusterName)},
+		}},
+	}
+}
+
+func (k kubeconfig) render(format string) (string, error) {
+	var out []byte
+	var err error
+	if format == "yaml" {
+		out, err = yaml.Marshal(k)
+	} else {
+		out, err = json.MarshalIndent(k, "", "  ")
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func generateKubeconfig(clusterEndpoint pulumi.StringOutput, certData pulumi.StringOutput, clusterName pulumi.StringOutput, auth *kubeconfigAuth) pulumi.StringOutput {
+	return pulumi.All(clusterEndpoint, certData, clusterName).ApplyT(func(args []interface{}) (string, error) {
+		return buildKubeconfig(args[0].(string), args[1].(string), args[2].(string), auth).render(auth.Format)
+	}).(pulumi.StringOutput)
+}
+
+// <cluster>.<format> for the default kubeconfig, <cluster>-<role>.<format> for the per role ones
+func kubeconfigFileName(clusterName string, role string, format string) string {
+	if role == "" {
+		return clusterName + "." + format
+	}
+	return clusterName + "-" + role + "." + format
+}
+
+// The files hold the account, role and profile names, so only the owner can read them
+func writeKubeconfigFile(dir string, name string, content string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+}
+
+// Resource: Stack outputs
+// Purpose: Exports the kubeconfig and one kubeconfig per role with cluster access as secrets. With
+// kubeconfigFile.enabled they are also written to kubeconfigFile.dir during pulumi up, never on preview.
+func exportKubeconfigs(ctx *pulumi.Context, eksCluster *eks.Cluster, ca pulumi.StringOutput, auth *kubeconfigAuth, eksConfig *eksConfig) error {
+	dir := ""
+	if eksConfig.KubeconfigFile.Enabled {
+		dir = eksConfig.KubeconfigFile.Dir
+		if dir == "" {
+			dir = defaultKubeconfigDir
+		}
+	}
+
+	output := func(role string, auth *kubeconfigAuth) pulumi.Output {
+		kubeconfig := generateKubeconfig(eksCluster.Endpoint, ca, eksCluster.Name, auth)
+		// Written as soon as the cluster outputs resolve, not after the update succeeds. Part of the exported value,
+		// so the stack waits for the file to be written
+		written := pulumi.All(eksCluster.Name, kubeconfig).ApplyT(func(args []interface{}) (string, error) {
+			content := args[1].(string)
+			if dir == "" || ctx.DryRun() {
+				return content, nil
+			}
+			return content, writeKubeconfigFile(dir, kubeconfigFileName(args[0].(string), role, auth.Format), content)
+		})
+		return pulumi.ToSecret(written)
+	}
+
+	ctx.Export("kubeconfig", output("", auth))
+
+	roleArns, err := kubeconfigRoles(&eksConfig.Access)
+	if err != nil {
+		return err
+	}
+	roles := pulumi.Map{}
+	for role, roleArn := range roleArns {
+		roles[role] = output(role, auth.withRole(roleArn))
+	}
+	if len(roles) > 0 {
+		ctx.Export("kubeconfigs", roles)
+	}
+	return nil
+}
+
+// Every IAM role the cluster grants access to, through aws-auth or an access entry, by a name derived from its ARN:
+// arn:aws:iam::123456789012:role/team/admins is team-admins. Users can't be assumed, so they get no kubeconfig.
+func kubeconfigRoles(access *Access) (map[string]string, error) {
+	roleArns := []string{}
+	if awsAuthEnabled(access) {
+		for _, m := range access.RoleMappings {
+			roleArns = append(roleArns, m.RoleArn)
+		}
+	}
+	for _, e := range access.Entries {
+		roleArns = append(roleArns, e.PrincipalArn)
+	}
+
+	roles := map[string]string{}
+	for _, roleArn := range roleArns {
+		name := accessEntryName(roleArn)
+		if !strings.HasPrefix(name, "role-") {
+			continue
+		}
+		name = kubeconfigRoleNameInvalid.ReplaceAllString(strings.TrimPrefix(name, "role-"), "-")
+		if other, ok := roles[name]; ok && other != roleArn {
+			return nil, fmt.Errorf("roles %s and %s would both export the kubeconfig %s", other, roleArn, name)
+		}
+		roles[name] = roleArn
+	}
+	return roles, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestKubeconfig(t *testing.T) {
+	auth := &kubeconfigAuth{
+		Region:        "us-east-1",
+		Profile:       "admin",
+		RoleArn:       "arn:aws:iam::123456789012:role/eks-admins",
+		Authenticator: "aws",
+		Env:           map[string]string{"AWS_STS_REGIONAL_ENDPOINTS": "regional"},
+	}
+	config := buildKubeconfig("https://example.eks.amazonaws.com", "Y2VydA==", "demo", auth)
+
+	for _, format := range kubeconfigFormats {
+		out, err := config.render(format)
+		assert.NoError(t, err)
+
+		// Loaded the way kubectl and the Kubernetes provider load it
+		loaded, err := clientcmd.Load([]byte(out))
+		if !assert.NoError(t, err, "The %s kubeconfig should load", format) {
+			continue
+		}
+		assert.NoError(t, clientcmd.Validate(*loaded), "The %s kubeconfig should be valid", format)
+		assert.Equal(t, "demo", loaded.CurrentContext)
+		assert.Equal(t, "demo", loaded.Contexts["demo"].AuthInfo)
+		assert.Equal(t, "https://example.eks.amazonaws.com", loaded.Clusters["demo"].Server)
+		assert.Equal(t, []byte("cert"), loaded.Clusters["demo"].CertificateAuthorityData)
+
+		exec := loaded.AuthInfos["demo"].Exec
+		assert.Equal(t, "client.authentication.k8s.io/v1beta1", exec.APIVersion)
+		assert.Equal(t, "aws", exec.Command)
+		assert.Equal(t, []string{"--region", "us-east-1", "--profile", "admin", "eks", "get-token", "--cluster-name", "demo",
+			"--role-arn", "arn:aws:iam::123456789012:role/eks-admins"}, exec.Args)
+		assert.Equal(t, []clientcmdapi.ExecEnvVar{{Name: "AWS_STS_REGIONAL_ENDPOINTS", Value: "regional"}}, exec.Env)
+	}
+
+	// aws-iam-authenticator has no profile flag, region and profile go through the environment
+	auth.Authenticator = "aws-iam-authenticator"
+	exec := buildKubeconfig("https://example.eks.amazonaws.com", "Y2VydA==", "demo", auth).Users[0].User.Exec
+	assert.Equal(t, []string{"token", "-i", "demo", "-r", "arn:aws:iam::123456789012:role/eks-admins"}, exec.Args)
+	assert.Equal(t, []execEnvVar{
+		{"AWS_PROFILE", "admin"},
+		{"AWS_REGION", "us-east-1"},
+		{"AWS_STS_REGIONAL_ENDPOINTS", "regional"},
+	}, exec.Env)
+	assert.Empty(t, auth.Env["AWS_REGION"], "The configured env should not be modified")
+}
+
+func TestKubeconfigRoles(t *testing.T) {
+	access := &Access{
+		AuthenticationMode: "API_AND_CONFIG_MAP",
+		RoleMappings: []RoleMapping{
+			{RoleArn: "arn:aws:iam::123456789012:role/eks-admins", Username: "admin"},
+			{RoleArn: "arn:aws:iam::123456789012:role/team/ci@deploy", Username: "ci"},
+		},
+		Entries: []AccessEntry{
+			{PrincipalArn: "arn:aws:iam::123456789012:role/eks-admins", Policy: "clusterAdmin"},
+			{PrincipalArn: "arn:aws:iam::123456789012:role/eks-developers", Policy: "edit"},
+			{PrincipalArn: "arn:aws:iam::123456789012:user/ops", Policy: "view"},
+		},
+	}
+	roles, err := kubeconfigRoles(access)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"eks-admins":     "arn:aws:iam::123456789012:role/eks-admins",
+		"eks-developers": "arn:aws:iam::123456789012:role/eks-developers",
+		"team-ci-deploy": "arn:aws:iam::123456789012:role/team/ci@deploy",
+	}, roles, "Each role once, users can't be assumed")
+
+	// aws-auth is ignored in API mode, its roles have no access
+	access.AuthenticationMode = "API"
+	roles, err = kubeconfigRoles(access)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"eks-admins":     "arn:aws:iam::123456789012:role/eks-admins",
+		"eks-developers": "arn:aws:iam::123456789012:role/eks-developers",
+	}, roles)
+
+	access.Entries = append(access.Entries, AccessEntry{PrincipalArn: "arn:aws:iam::123456789012:role/eks/developers", Policy: "view"})
+	_, err = kubeconfigRoles(access)
+	assert.Error(t, err, "Two roles should never share a kubeconfig name")
+}
+
+func TestKubeconfigFile(t *testing.T) {
+	auth := &kubeconfigAuth{Authenticator: "aws", Format: "yaml", RoleArn: "arn:aws:iam::123456789012:role/eks-admins"}
+	readOnly := auth.withRole("arn:aws:iam::123456789012:role/eks-read-only")
+	assert.Equal(t, "arn:aws:iam::123456789012:role/eks-admins", auth.RoleArn, "The default role should be kept")
+	assert.Equal(t, "demo-read-only.yaml", kubeconfigFileName("demo", "read-only", readOnly.Format))
+
+	dir := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, writeKubeconfigFile(dir, "demo.yaml", "apiVersion: v1\n"))
+	info, err := os.Stat(filepath.Join(dir, "demo.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
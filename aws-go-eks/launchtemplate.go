@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const userDataBoundary = "==EKSNODE=="
+
+// Everything a node needs to join the cluster on its own, only used when we bootstrap a custom AMI
+type clusterBootstrap struct {
+	Name     string
+	Endpoint string
+	CA       string
+	// Service CIDR, only AL2023 needs it to bootstrap a custom AMI
+	CIDR string
+}
+
+// Resource: Launch Template
+// Purpose: Node settings that a bare managed node group can't express: IMDSv2, root volume, AMI and user data.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/launch-templates.html
+func setupLaunchTemplate(ctx *pulumi.Context, ng *NodeGroup, eksCluster *eks.Cluster, ca pulumi.StringOutput) (*ec2.LaunchTemplate, error) {
+	lt := ng.LaunchTemplate
+	family := amiFamily(ng.AmiType)
+
+	if err := validateLaunchTemplate(family, lt); err != nil {
+		return nil, fmt.Errorf("node group %s: %w", ng.Name, err)
+	}
+
+	httpTokens := lt.HttpTokens
+	if httpTokens == "" {
+		httpTokens = "required"
+	}
+	// 2 hops so pods that don't use host networking can still reach IMDS
+	hopLimit := lt.HttpPutResponseHopLimit
+	if hopLimit == 0 {
+		hopLimit = 2
+	}
+
+	volumeSize := lt.VolumeSize
+	if volumeSize == 0 {
+		volumeSize = ng.DiskSize
+	}
+	volumeType := lt.VolumeType
+	if volumeType == "" {
+		volumeType = "gp3"
+	}
+	ebs := &ec2.LaunchTemplateBlockDeviceMappingEbsArgs{
+		VolumeType:          pulumi.String(volumeType),
+		Encrypted:           pulumi.String("true"),
+		DeleteOnTermination: pulumi.String("true"),
+	}
+	if volumeSize > 0 {
+		ebs.VolumeSize = pulumi.Int(volumeSize)
+	}
+	if lt.VolumeIops > 0 {
+		ebs.Iops = pulumi.Int(lt.VolumeIops)
+	}
+	if lt.VolumeThroughput > 0 {
+		ebs.Throughput = pulumi.Int(lt.VolumeThroughput)
+	}
+
+	// Bottlerocket keeps the OS on xvda and containers on the xvdb data volume
+	deviceName := "/dev/xvda"
+	if family == "bottlerocket" {
+		deviceName = "/dev/xvdb"
+	}
+
+	serviceCidr := eksCluster.KubernetesNetworkConfig.ServiceIpv4Cidr().Elem()
+	userData := pulumi.All(eksCluster.Name, eksCluster.Endpoint, ca, serviceCidr).ApplyT(func(args []interface{}) (string, error) {
+		cluster := clusterBootstrap{
+			Name:     args[0].(string),
+			Endpoint: args[1].(string),
+			CA:       args[2].(string),
+			CIDR:     args[3].(string),
+		}
+		data, err := renderUserData(family, lt, &cluster)
+		if err != nil || data == "" {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString([]byte(data)), nil
+	}).(pulumi.StringOutput)
+
+	// Node group names are only unique within the cluster, the cluster name tells the stacks' instances apart
+	nameTags := pulumi.StringMap{"Name": pulumi.Sprintf("%s-%s", eksCluster.Name, ng.Name)}
+	ltArgs := &ec2.LaunchTemplateArgs{
+		Description:          pulumi.String(fmt.Sprintf("Managed node group %s", ng.Name)),
+		UpdateDefaultVersion: pulumi.Bool(true),
+		MetadataOptions: &ec2.LaunchTemplateMetadataOptionsArgs{
+			HttpEndpoint:            pulumi.String("enabled"),
+			HttpTokens:              pulumi.String(httpTokens),
+			HttpPutResponseHopLimit: pulumi.Int(hopLimit),
+		},
+		BlockDeviceMappings: ec2.LaunchTemplateBlockDeviceMappingArray{
+			&ec2.LaunchTemplateBlockDeviceMappingArgs{
+				DeviceName: pulumi.String(deviceName),
+				Ebs:        ebs,
+			},
+		},
+		UserData: userData,
+		TagSpecifications: ec2.LaunchTemplateTagSpecificationArray{
+			&ec2.LaunchTemplateTagSpecificationArgs{
+				ResourceType: pulumi.String("instance"),
+				Tags:         nameTags,
+			},
+			&ec2.LaunchTemplateTagSpecificationArgs{
+				ResourceType: pulumi.String("volume"),
+				Tags:         nameTags,
+			},
+		},
+	}
+	if lt.ImageId != "" {
+		ltArgs.ImageId = pulumi.String(lt.ImageId)
+	}
+	// Only the key pair, the template keeps the cluster security group, which doesn't open port 22
+	if lt.KeyName != "" {
+		ltArgs.KeyName = pulumi.String(lt.KeyName)
+	}
+
+	return ec2.NewLaunchTemplate(ctx, ng.Name+"-lt", ltArgs)
+}
+
+// Pins the node group to the latest template version, so every template change rolls the nodes
+func nodeGroupLaunchTemplate(lt *ec2.LaunchTemplate) *eks.NodeGroupLaunchTemplateArgs {
+	return &eks.NodeGroupLaunchTemplateArgs{
+		Id: lt.ID(),
+		Version: lt.LatestVersion.ApplyT(func(v int) string {
+			return strconv.Itoa(v)
+		}).(pulumi.StringOutput),
+	}
+}
+
+func amiFamily(amiType string) string {
+	switch {
+	case strings.HasPrefix(amiType, "BOTTLEROCKET"):
+		return "bottlerocket"
+	case strings.HasPrefix(amiType, "AL2023"):
+		return "al2023"
+	}
+	return "al2"
+}
+
+func validateLaunchTemplate(family string, lt *LaunchTemplate) error {
+	switch lt.HttpTokens {
+	case "", "required", "optional":
+	default:
+		return fmt.Errorf("httpTokens must be required or optional, got %q", lt.HttpTokens)
+	}
+	if family == "bottlerocket" && (lt.KubeletExtraArgs != "" || lt.BootstrapExtraArgs != "") {
+		return fmt.Errorf("kubeletExtraArgs and bootstrapExtraArgs are not supported on Bottlerocket, use settings in userData instead")
+	}
+	if family == "al2023" && lt.BootstrapExtraArgs != "" {
+		return fmt.Errorf("bootstrapExtraArgs is not supported on AL2023, nodeadm has no bootstrap.sh")
+	}
+	// EKS runs bootstrap.sh itself for its own AMIs and won't take extra arguments
+	if family == "al2" && lt.ImageId == "" && (lt.KubeletExtraArgs != "" || lt.BootstrapExtraArgs != "" || lt.MaxPods > 0) {
+		return fmt.Errorf("kubeletExtraArgs, bootstrapExtraArgs and maxPods need a custom imageId on AL2")
+	}
+	return nil
+}
+
+// Renders the user data for a node group, an empty string means the EKS default is good enough
+func renderUserData(family string, lt *LaunchTemplate, cluster *clusterBootstrap) (string, error) {
+	switch family {
+	case "bottlerocket":
+		return renderBottlerocketUserData(lt, cluster), nil
+	case "al2":
+		return renderAL2UserData(lt, cluster), nil
+	case "al2023":
+		return renderAL2023UserData(lt, cluster)
+	}
+	return "", fmt.Errorf("unknown AMI family %q", family)
+}
+
+// Bottlerocket takes TOML settings, EKS merges the cluster settings in unless we run a custom AMI
+// Docs: https://github.com/bottlerocket-os/bottlerocket#settings
+func renderBottlerocketUserData(lt *LaunchTemplate, cluster *clusterBootstrap) string {
+	settings := []string{}
+	if lt.ImageId != "" {
+		settings = append(settings,
+			fmt.Sprintf("cluster-name = %q", cluster.Name),
+			fmt.Sprintf("api-server = %q", cluster.Endpoint),
+			fmt.Sprintf("cluster-certificate = %q", cluster.CA),
+		)
+	}
+	if lt.MaxPods > 0 {
+		settings = append(settings, fmt.Sprintf("max-pods = %d", lt.MaxPods))
+	}
+
+	var b strings.Builder
+	if len(settings) > 0 {
+		b.WriteString("[settings.kubernetes]\n")
+		for _, s := range settings {
+			b.WriteString(s + "\n")
+		}
+	}
+	if lt.UserData != "" {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(strings.TrimSpace(lt.UserData) + "\n")
+	}
+	return b.String()
+}
+
+// Managed node groups only accept MIME multi-part user data on AL2, EKS appends its own bootstrap part
+// unless we run a custom AMI, in which case we have to call bootstrap.sh ourselves
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/launch-templates.html#launch-template-user-data
+func renderAL2UserData(lt *LaunchTemplate, cluster *clusterBootstrap) string {
+	script := []string{}
+	if lt.UserData != "" {
+		script = append(script, strings.TrimSpace(lt.UserData))
+	}
+	if lt.ImageId != "" {
+		kubeletArgs := lt.KubeletExtraArgs
+		bootstrapArgs := []string{
+			cluster.Name,
+			"--b64-cluster-ca " + cluster.CA,
+			"--apiserver-endpoint " + cluster.Endpoint,
+		}
+		if lt.MaxPods > 0 {
+			kubeletArgs = strings.TrimSpace(fmt.Sprintf("%s --max-pods=%d", kubeletArgs, lt.MaxPods))
+			bootstrapArgs = append(bootstrapArgs, "--use-max-pods false")
+		}
+		if kubeletArgs != "" {
+			bootstrapArgs = append(bootstrapArgs, fmt.Sprintf("--kubelet-extra-args '%s'", kubeletArgs))
+		}
+		if lt.BootstrapExtraArgs != "" {
+			bootstrapArgs = append(bootstrapArgs, lt.BootstrapExtraArgs)
+		}
+		script = append(script, "/etc/eks/bootstrap.sh "+strings.Join(bootstrapArgs, " "))
+	}
+	if len(script) == 0 {
+		return ""
+	}
+	return renderMimeUserData([]userDataPart{shellScriptPart(script)})
+}
+
+// NodeConfig read by nodeadm, JSON is valid YAML so no YAML library is needed
+// Docs: https://awslabs.github.io/amazon-eks-ami/nodeadm/
+type nodeConfig struct {
+	ApiVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Spec       nodeConfigSpec `json:"spec"`
+}
+
+type nodeConfigSpec struct {
+	Cluster *nodeConfigCluster `json:"cluster,omitempty"`
+	Kubelet *nodeConfigKubelet `json:"kubelet,omitempty"`
+}
+
+type nodeConfigCluster struct {
+	Name                 string `json:"name"`
+	ApiServerEndpoint    string `json:"apiServerEndpoint"`
+	CertificateAuthority string `json:"certificateAuthority"`
+	CIDR                 string `json:"cidr"`
+}
+
+type nodeConfigKubelet struct {
+	Config map[string]interface{} `json:"config,omitempty"`
+	Flags  []string               `json:"flags,omitempty"`
+}
+
+// AL2023 bootstraps with nodeadm, EKS merges its own NodeConfig with ours unless we run a custom AMI,
+// in which case ours has to carry the cluster details as well
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/al2023.html
+func renderAL2023UserData(lt *LaunchTemplate, cluster *clusterBootstrap) (string, error) {
+	spec := nodeConfigSpec{}
+	if lt.ImageId != "" {
+		spec.Cluster = &nodeConfigCluster{cluster.Name, cluster.Endpoint, cluster.CA, cluster.CIDR}
+	}
+	if lt.KubeletExtraArgs != "" || lt.MaxPods > 0 {
+		spec.Kubelet = &nodeConfigKubelet{Flags: strings.Fields(lt.KubeletExtraArgs)}
+		if lt.MaxPods > 0 {
+			spec.Kubelet.Config = map[string]interface{}{"maxPods": lt.MaxPods}
+		}
+	}
+
+	parts := []userDataPart{}
+	if spec.Cluster != nil || spec.Kubelet != nil {
+		config, err := json.Marshal(nodeConfig{"node.eks.aws/v1alpha1", "NodeConfig", spec})
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, userDataPart{"application/node.eks.aws", string(config) + "\n"})
+	}
+	if lt.UserData != "" {
+		parts = append(parts, shellScriptPart([]string{strings.TrimSpace(lt.UserData)}))
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	return renderMimeUserData(parts), nil
+}
+
+type userDataPart struct {
+	ContentType string
+	Body        string
+}
+
+func shellScriptPart(script []string) userDataPart {
+	return userDataPart{
+		ContentType: "text/x-shellscript; charset=\"us-ascii\"",
+		Body:        "#!/bin/bash\nset -ex\n" + strings.Join(script, "\n") + "\n",
+	}
+}
+
+func renderMimeUserData(parts []userDataPart) string {
+	var b strings.Builder
+	b.WriteString("MIME-Version: 1.0\n")
+	b.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\n\n", userDataBoundary))
+	for _, p := range parts {
+		b.WriteString("--" + userDataBoundary + "\n")
+		b.WriteString("Content-Type: " + p.ContentType + "\n\n")
+		b.WriteString(p.Body + "\n")
+	}
+	b.WriteString("--" + userDataBoundary + "--\n")
+	return b.String()
+}
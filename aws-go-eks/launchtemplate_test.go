@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderUserData(t *testing.T) {
+	cluster := clusterBootstrap{"test-cluster", "https://example.eks.amazonaws.com", "Y2VydA==", "172.20.0.0/16"}
+
+	// AL2 with a custom AMI is a valid MIME document that ends with our own bootstrap call
+	lt := LaunchTemplate{ImageId: "ami-123", MaxPods: 110, KubeletExtraArgs: "--node-labels=a=b", UserData: "echo hello"}
+	data, err := renderUserData("al2", &lt, &cluster)
+	assert.NoError(t, err)
+
+	header, body := splitMessage(data)
+	mediaType, params, err := mime.ParseMediaType(header["Content-Type"])
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	part, err := reader.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, `text/x-shellscript; charset="us-ascii"`, part.Header.Get("Content-Type"))
+	script, _ := ioutil.ReadAll(part)
+	assert.Contains(t, string(script), "echo hello")
+	assert.Contains(t, string(script), "/etc/eks/bootstrap.sh test-cluster --b64-cluster-ca Y2VydA== --apiserver-endpoint https://example.eks.amazonaws.com --use-max-pods false --kubelet-extra-args '--node-labels=a=b --max-pods=110'")
+
+	// AL2 with the EKS AMI and nothing to add keeps the EKS default
+	data, err = renderUserData("al2", &LaunchTemplate{}, &cluster)
+	assert.NoError(t, err)
+	assert.Equal(t, "", data)
+
+	// Bottlerocket gets TOML, not MIME
+	data, err = renderUserData("bottlerocket", &LaunchTemplate{MaxPods: 58}, &cluster)
+	assert.NoError(t, err)
+	assert.Equal(t, "[settings.kubernetes]\nmax-pods = 58\n", data)
+
+	// AL2023 with a custom AMI gets a NodeConfig carrying the cluster, then the script
+	data, err = renderUserData("al2023", &LaunchTemplate{ImageId: "ami-123", MaxPods: 110, UserData: "echo hello"}, &cluster)
+	assert.NoError(t, err)
+	header, body = splitMessage(data)
+	_, params, err = mime.ParseMediaType(header["Content-Type"])
+	assert.NoError(t, err)
+	reader = multipart.NewReader(strings.NewReader(body), params["boundary"])
+	part, err = reader.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, "application/node.eks.aws", part.Header.Get("Content-Type"))
+	config, _ := ioutil.ReadAll(part)
+	assert.JSONEq(t, `{"apiVersion":"node.eks.aws/v1alpha1","kind":"NodeConfig","spec":{
+		"cluster":{"name":"test-cluster","apiServerEndpoint":"https://example.eks.amazonaws.com","certificateAuthority":"Y2VydA==","cidr":"172.20.0.0/16"},
+		"kubelet":{"config":{"maxPods":110}}}}`, string(config))
+	part, err = reader.NextPart()
+	assert.NoError(t, err)
+	script, _ = ioutil.ReadAll(part)
+	assert.Contains(t, string(script), "echo hello")
+
+	assert.Error(t, validateLaunchTemplate("al2", &LaunchTemplate{MaxPods: 110}))
+	assert.NoError(t, validateLaunchTemplate("al2023", &LaunchTemplate{MaxPods: 110}))
+	assert.Error(t, validateLaunchTemplate("bottlerocket", &LaunchTemplate{KubeletExtraArgs: "--v=2"}))
+}
+
+func splitMessage(data string) (map[string]string, string) {
+	parts := strings.SplitN(data, "\n\n", 2)
+	header := map[string]string{}
+	for _, l := range strings.Split(parts[0], "\n") {
+		kv := strings.SplitN(l, ": ", 2)
+		header[kv[0]] = kv[1]
+	}
+	return header, parts[1]
+}
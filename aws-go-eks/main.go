@@ -5,6 +5,12 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
+type stackSettings struct {
+	NamePrefix   string
+	Tags         map[string]string
+	ResourceTags map[string]map[string]string
+}
+
 type subnetConfig struct {
 	Name string
 	Cidr string
@@ -22,10 +28,145 @@ type Scaling struct {
 	Max    int
 }
 
+type Taint struct {
+	Key    string
+	Value  string
+	Effect string
+}
+
+type LaunchTemplate struct {
+	HttpTokens              string
+	HttpPutResponseHopLimit int
+	VolumeSize              int
+	VolumeType              string
+	VolumeIops              int
+	VolumeThroughput        int
+	ImageId                 string
+	KubeletExtraArgs        string
+	BootstrapExtraArgs      string
+	MaxPods                 int
+	UserData                string
+	KeyName                 string
+}
+
+type UpdateConfig struct {
+	MaxUnavailable           int
+	MaxUnavailablePercentage int
+}
+
+type RemoteAccess struct {
+	KeyName                string
+	SourceSecurityGroupIds []string
+}
+
 type NodeGroup struct {
-	CapacityType string
-	NodeType     string
-	Scaling      Scaling
+	Name           string
+	CapacityType   string
+	InstanceTypes  []string
+	Scaling        Scaling
+	Subnets        string
+	Labels         map[string]string
+	Taints         []Taint
+	DiskSize       int
+	AmiType        string
+	LaunchTemplate *LaunchTemplate
+	System         bool
+
+	UpdateConfig       *UpdateConfig
+	ReleaseVersion     string
+	ForceUpdateVersion bool
+	RemoteAccess       *RemoteAccess
+}
+
+type FargateSelector struct {
+	Namespace string
+	Labels    map[string]string
+}
+
+type FargateProfile struct {
+	Name      string
+	Selectors []FargateSelector
+	Subnets   string
+}
+
+type KarpenterNodePool struct {
+	Name                string
+	AmiFamily           string
+	CapacityTypes       []string
+	Architectures       []string
+	InstanceTypes       []string
+	Labels              map[string]string
+	Taints              []Taint
+	Limits              map[string]string
+	ConsolidationPolicy string
+}
+
+type Karpenter struct {
+	Version   string
+	NodePools []KarpenterNodePool
+}
+
+type ManagedAddon struct {
+	Version             string
+	ConfigurationValues string
+	ResolveConflicts    string
+	Identity            string
+}
+
+// Settings of a Helm addon in eks.addons, empty fields keep the addon's defaults
+type AddonSettings struct {
+	// Enabled unless set to false
+	Enabled     *bool
+	Version     string
+	Namespace   string
+	Repo        string
+	Values      map[string]interface{}
+	ValuesFiles []string
+	// chart (the default) or release
+	Install string
+	Release AddonRelease
+}
+
+// Helm options of an addon installed as a release
+type AddonRelease struct {
+	// True unless set to false
+	Atomic          *bool
+	Wait            *bool
+	CreateNamespace *bool
+	CleanupOnFail   *bool
+	SkipCrds        bool
+	// Seconds, 300 by default
+	Timeout int
+}
+
+// Helm addons by name, a plain list of names enables them with their defaults
+type AddonsConfig map[string]AddonSettings
+
+type RoleMapping struct {
+	RoleArn  string
+	Username string
+	Groups   []string
+}
+
+type UserMapping struct {
+	UserArn  string
+	Username string
+	Groups   []string
+}
+
+type AccessEntry struct {
+	PrincipalArn     string
+	Policy           string
+	Namespaces       []string
+	KubernetesGroups []string
+	Username         string
+}
+
+type Access struct {
+	AuthenticationMode string
+	RoleMappings       []RoleMapping
+	UserMappings       []UserMapping
+	Entries            []AccessEntry
 }
 
 type FirewallRule struct {
@@ -40,10 +181,73 @@ type Sg struct {
 	Egress  []FirewallRule
 }
 
+type Logging struct {
+	Types         []string
+	RetentionDays int
+	KmsKeyArn     string
+}
+
+type Encryption struct {
+	Enabled   bool
+	KmsKeyArn string
+	KeyAlias  string
+}
+
+type NodeAccess struct {
+	Ssm          bool
+	SsmEndpoints bool
+}
+
+type Workload struct {
+	Name           string
+	Namespace      string
+	ServiceAccount string
+	PolicyArns     []string
+	Identity       string
+
+	CreateServiceAccount bool
+}
+
+type ClusterAutoscaler struct {
+	Expander string
+}
+
+type Kubeconfig struct {
+	Format        string
+	RoleArn       string
+	Authenticator string
+	Env           map[string]string
+}
+
+type KubeconfigFile struct {
+	Enabled bool
+	Dir     string
+}
+
 type eksConfig struct {
-	Addons    []string
-	NodeGroup NodeGroup
-	Sg        Sg
+	Addons     AddonsConfig
+	NodeGroups []NodeGroup
+	Sg         Sg
+	Logging    Logging
+	Encryption Encryption
+
+	FargateProfiles  []FargateProfile
+	CoreDnsOnFargate bool
+	Karpenter        Karpenter
+	ManagedAddons    map[string]ManagedAddon
+	Access           Access
+
+	ClusterAutoscaler  ClusterAutoscaler
+	NodeReleaseVersion string
+	NodeAccess         NodeAccess
+	AddonIdentity      map[string]string
+	Workloads          []Workload
+	Kubeconfig         Kubeconfig
+	KubeconfigFile     KubeconfigFile
+	OidcThumbprint     string
+	OidcProviderArn    string
+	// Physical name of the cluster, Pulumi names it when empty
+	ClusterName string
 }
 
 func main() {
@@ -55,12 +259,27 @@ func main() {
 		conf.RequireObject("network", &networkConfig)
 		conf.RequireObject("eks", &eksConfig)
 
-		netResources, err := setupNetwork(ctx, &networkConfig)
+		// Unknown addons fail before anything is created
+		_, err := enabledAddons(&eksConfig)
+		if err != nil {
+			return err
+		}
+
+		settings, err := loadStackSettings(ctx, conf)
+		if err != nil {
+			return err
+		}
+		err = registerTagTransformation(ctx, settings)
+		if err != nil {
+			return err
+		}
+
+		netResources, err := setupNetwork(ctx, settings, &networkConfig, karpenterDiscoveryTags(settings, &eksConfig))
 		if err != nil {
 			return err
 		}
 
-		eksResources, err := setupEKS(ctx, netResources, &eksConfig)
+		eksResources, err := setupEKS(ctx, settings, netResources, &eksConfig)
 		if err != nil {
 			return err
 		}
@@ -13,11 +13,56 @@ import (
 type mocks int
 
 func (mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
-	return args.Name + "_id", args.Inputs, nil
+	outputs := args.Inputs.Copy()
+	if args.TypeToken == "aws:iam/role:Role" {
+		outputs["arn"] = resource.NewStringProperty("arn:aws:iam::123456789012:role/" + args.Name)
+	}
+	return args.Name + "_id", outputs, nil
 }
 
 func (mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
-	return args.Args, nil
+	outputs := args.Args.Copy()
+	switch args.Token {
+	case "aws:index/getCallerIdentity:getCallerIdentity":
+		outputs["accountId"] = resource.NewStringProperty("123456789012")
+	case "aws:index/getRegion:getRegion":
+		outputs["name"] = resource.NewStringProperty("eu-west-1")
+	case "aws:ssm/getParameter:getParameter":
+		outputs["value"] = resource.NewStringProperty("1.30.4-20240917")
+	}
+	return outputs, nil
+}
+
+// Same as mocks, and keeps the inputs of every resource by name for the tests to check
+type recordingMocks struct {
+	mocks
+	mu     sync.Mutex
+	inputs map[string]resource.PropertyMap
+	// The same by type token and name, for resources of different types sharing a name
+	typed map[string]resource.PropertyMap
+	calls map[string][]resource.PropertyMap
+}
+
+func (m *recordingMocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inputs == nil {
+		m.inputs = map[string]resource.PropertyMap{}
+		m.typed = map[string]resource.PropertyMap{}
+	}
+	m.inputs[args.Name] = args.Inputs
+	m.typed[args.TypeToken+"::"+args.Name] = args.Inputs
+	return m.mocks.NewResource(args)
+}
+
+func (m *recordingMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.calls == nil {
+		m.calls = map[string][]resource.PropertyMap{}
+	}
+	m.calls[args.Token] = append(m.calls[args.Token], args.Args)
+	return m.mocks.Call(args)
 }
 
 // Tests
@@ -26,7 +71,7 @@ func TestSetupNetwork(t *testing.T) {
 
 		networkConfigInput := networkData{"test-vpc", []subnetConfig{{"public", "192.168.0.0/24"}}, []subnetConfig{{"private", "192.168.1.0/24"}}}
 
-		network, err := setupNetwork(ctx, &networkConfigInput)
+		network, err := setupNetwork(ctx, &stackSettings{NamePrefix: "pulumi-eks-go"}, &networkConfigInput, nil)
 		assert.NoError(t, err)
 
 		var wg sync.WaitGroup
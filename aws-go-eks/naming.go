@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// AWS length limits of the names we set ourselves, everything else is auto-named by Pulumi
+const (
+	maxClusterNameLength   = 100
+	maxNodeGroupNameLength = 63
+	maxQueueNameLength     = 80
+	maxTagValueLength      = 256
+	nameHashLength         = 8
+	legacyNetworkNameBase  = "pulumi-eks-go"
+)
+
+// Physical name of a resource, unique to the stack: <namePrefix>-<name>, the prefix defaults to <project>-<stack>
+func physicalName(settings *stackSettings, name string, maxLen int) string {
+	return limitName(settings.NamePrefix+"-"+name, maxLen)
+}
+
+// Names over the limit are cut and end with a hash of the full name instead, so they stay stable and unique
+func limitName(name string, maxLen int) string {
+	if len(name) <= maxLen {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	return name[:maxLen-nameHashLength-1] + "-" + hex.EncodeToString(sum[:])[:nameHashLength]
+}
+
+// Network resources used to have the hardcoded prefix in their logical name,
+// the alias lets stacks created back then keep their resources
+func legacyNetworkAlias(name string) pulumi.ResourceOption {
+	return pulumi.Aliases([]pulumi.Alias{{Name: pulumi.String(legacyNetworkNameBase + "-" + name)}})
+}
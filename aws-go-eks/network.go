@@ -13,16 +13,16 @@ type networkResources struct {
 	privSubnets []*ec2.Subnet
 }
 
-func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResources, error) {
-	prefix := "pulumi-eks-go"
+// privSubnetTags are added to the private subnets, e.g. for discovery by the cluster
+// The common tags come from the stack transformation, only Name is set here
+func setupNetwork(ctx *pulumi.Context, settings *stackSettings, netConfig *networkData, privSubnetTags map[string]string) (*networkResources, error) {
+	nameTag := func(name string) string {
+		return physicalName(settings, name, maxTagValueLength)
+	}
 	resourceTags := make(map[string]string)
 
-	resourceTags["CreatedBy"] = "pulumi-eks-go"
-	resourceTags["GitOrg"] = "gsweene2"
-	resourceTags["GitRepo"] = "pulumi"
-
 	// VPC Args
-	resourceTags["Name"] = prefix + "-vpc"
+	resourceTags["Name"] = nameTag("vpc")
 	vpcArgs := &ec2.VpcArgs{
 		CidrBlock:          pulumi.String(netConfig.Vpc),
 		EnableDnsHostnames: pulumi.Bool(true),
@@ -31,7 +31,7 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 	}
 
 	// VPC
-	vpc, err := ec2.NewVpc(ctx, prefix+"-vpc", vpcArgs)
+	vpc, err := ec2.NewVpc(ctx, "vpc", vpcArgs, legacyNetworkAlias("vpc"))
 	if err != nil {
 		fmt.Println(err.Error())
 		return &networkResources{}, err
@@ -46,12 +46,19 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 	privSubnets := []*ec2.Subnet{}
 	// 3 Private Subnets
 	for i, s := range netConfig.PrivateSubnets {
-		resourceTags["Name"] = s.Name
+		subnetTags := map[string]string{}
+		for k, v := range resourceTags {
+			subnetTags[k] = v
+		}
+		for k, v := range privSubnetTags {
+			subnetTags[k] = v
+		}
+		subnetTags["Name"] = nameTag(s.Name)
 		sub, err := ec2.NewSubnet(ctx, s.Name, &ec2.SubnetArgs{
 			VpcId:            vpc.ID(),
 			CidrBlock:        pulumi.String(s.Cidr),
 			AvailabilityZone: pulumi.String(availabilityZones[i%3]),
-			Tags:             pulumi.ToStringMap(resourceTags),
+			Tags:             pulumi.ToStringMap(subnetTags),
 		})
 		if err != nil {
 			return &networkResources{}, err
@@ -63,7 +70,7 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 	pubSubnets := []*ec2.Subnet{}
 	// 3 Private Subnets
 	for i, s := range netConfig.PublicSubnets {
-		resourceTags["Name"] = s.Name
+		resourceTags["Name"] = nameTag(s.Name)
 		sub, err := ec2.NewSubnet(ctx, s.Name, &ec2.SubnetArgs{
 			VpcId:            vpc.ID(),
 			CidrBlock:        pulumi.String(s.Cidr),
@@ -81,9 +88,10 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 	// Docs: https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/elastic-ip-addresses-eip.html
 
 	// EIP for NAT GW
-	eip1, err := ec2.NewEip(ctx, prefix+"-eip1", &ec2.EipArgs{
-		Vpc: pulumi.Bool(true),
-	})
+	eip1, err := ec2.NewEip(ctx, "eip1", &ec2.EipArgs{
+		Vpc:  pulumi.Bool(true),
+		Tags: pulumi.StringMap{"Name": pulumi.String(nameTag("eip1"))},
+	}, legacyNetworkAlias("eip1"))
 	if err != nil {
 		return &networkResources{}, err
 	}
@@ -94,13 +102,13 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 
 	// NAT Gateway with EIP
 	// this is the cheaper solution, because it's using only one AZ
-	resourceTags["Name"] = prefix + "-nat-gw-1"
-	natGw1, err := ec2.NewNatGateway(ctx, prefix+"-nat-gw-1", &ec2.NatGatewayArgs{
+	resourceTags["Name"] = nameTag("nat-gw-1")
+	natGw1, err := ec2.NewNatGateway(ctx, "nat-gw-1", &ec2.NatGatewayArgs{
 		AllocationId: eip1.ID(),
 		// NAT must reside in public subnet for private instance internet access
 		SubnetId: pubSubnets[0].ID(),
 		Tags:     pulumi.ToStringMap(resourceTags),
-	})
+	}, legacyNetworkAlias("nat-gw-1"))
 	if err != nil {
 		return &networkResources{}, err
 	}
@@ -110,11 +118,11 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 	// Docs: https://docs.aws.amazon.com/vpc/latest/userguide/VPC_Internet_Gateway.html
 
 	// IGW for the Public Subnets
-	resourceTags["Name"] = prefix + "-gw"
-	igw1, err := ec2.NewInternetGateway(ctx, prefix+"-gw", &ec2.InternetGatewayArgs{
+	resourceTags["Name"] = nameTag("gw")
+	igw1, err := ec2.NewInternetGateway(ctx, "gw", &ec2.InternetGatewayArgs{
 		VpcId: vpc.ID(),
 		Tags:  pulumi.ToStringMap(resourceTags),
-	})
+	}, legacyNetworkAlias("gw"))
 	if err != nil {
 		return &networkResources{}, err
 	}
@@ -124,8 +132,8 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 	// Docs: https://docs.aws.amazon.com/vpc/latest/userguide/VPC_Route_Tables.html
 
 	// Private Route Table for Private Subnets
-	resourceTags["Name"] = prefix + "-rtb-private-1"
-	privateRouteTable, err := ec2.NewRouteTable(ctx, prefix+"-rtb-private-1", &ec2.RouteTableArgs{
+	resourceTags["Name"] = nameTag("rtb-private-1")
+	privateRouteTable, err := ec2.NewRouteTable(ctx, "rtb-private-1", &ec2.RouteTableArgs{
 		VpcId: vpc.ID(),
 		Routes: ec2.RouteTableRouteArray{
 			&ec2.RouteTableRouteArgs{
@@ -135,14 +143,14 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 			},
 		},
 		Tags: pulumi.ToStringMap(resourceTags),
-	})
+	}, legacyNetworkAlias("rtb-private-1"))
 	if err != nil {
 		return &networkResources{}, err
 	}
 
 	// Public Route Table for Public Subnets
-	resourceTags["Name"] = prefix + "-rtb-public-1"
-	publicRouteTable, err := ec2.NewRouteTable(ctx, prefix+"-rtb-public-1", &ec2.RouteTableArgs{
+	resourceTags["Name"] = nameTag("rtb-public-1")
+	publicRouteTable, err := ec2.NewRouteTable(ctx, "rtb-public-1", &ec2.RouteTableArgs{
 		VpcId: vpc.ID(),
 		Routes: ec2.RouteTableRouteArray{
 			// To Internet via IGW
@@ -152,17 +160,17 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 			},
 		},
 		Tags: pulumi.ToStringMap(resourceTags),
-	})
+	}, legacyNetworkAlias("rtb-public-1"))
 	if err != nil {
 		return &networkResources{}, err
 	}
 
 	// Associate Private Subs with Private Route Tables
 	for i, v := range privSubnets {
-		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("%s-rtb-priv-%d", prefix, i), &ec2.RouteTableAssociationArgs{
+		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("rtb-priv-%d", i), &ec2.RouteTableAssociationArgs{
 			SubnetId:     v.ID(),
 			RouteTableId: privateRouteTable.ID(),
-		})
+		}, legacyNetworkAlias(fmt.Sprintf("rtb-priv-%d", i)))
 		if err != nil {
 			return &networkResources{}, err
 		}
@@ -170,10 +178,10 @@ func setupNetwork(ctx *pulumi.Context, netConfig *networkData) (*networkResource
 
 	// Associate Public Subs with Public Route Tables
 	for i, v := range pubSubnets {
-		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("%s-rtb-pub-%d", prefix, i), &ec2.RouteTableAssociationArgs{
+		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("rtb-pub-%d", i), &ec2.RouteTableAssociationArgs{
 			SubnetId:     v.ID(),
 			RouteTableId: publicRouteTable.ID(),
-		})
+		}, legacyNetworkAlias(fmt.Sprintf("rtb-pub-%d", i)))
 		if err != nil {
 			return &networkResources{}, err
 		}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const ssmManagedInstancePolicy = "arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore"
+
+// Endpoints the SSM agent talks to, needed when the nodes have no route to the public SSM endpoints
+// Docs: https://docs.aws.amazon.com/systems-manager/latest/userguide/setup-create-vpc.html
+var ssmEndpointServices = []string{"ssm", "ssmmessages", "ec2messages"}
+
+// Policies of the node role, plus the one the SSM agent needs when Session Manager access is on
+func nodeRolePolicies(nodeAccess *NodeAccess) []string {
+	policies := []string{
+		"arn:aws:iam::aws:policy/AmazonEKSWorkerNodePolicy",
+		"arn:aws:iam::aws:policy/AmazonEKS_CNI_Policy",
+		"arn:aws:iam::aws:policy/AmazonEC2ContainerRegistryReadOnly",
+	}
+	if nodeAccess.Ssm {
+		policies = append(policies, ssmManagedInstancePolicy)
+	}
+	return policies
+}
+
+// Resource: VPC Interface Endpoints
+// Purpose: Lets the SSM agent of the nodes reach Session Manager through the VPC instead of the NAT gateway.
+// Docs: https://docs.aws.amazon.com/vpc/latest/privatelink/create-interface-endpoint.html
+func setupSsmEndpoints(ctx *pulumi.Context, netResources *networkResources) error {
+	region, err := aws.GetRegion(ctx, nil)
+	if err != nil {
+		return err
+	}
+	subnetIds, err := nodeGroupSubnets(netResources, "private")
+	if err != nil {
+		return err
+	}
+
+	sg, err := ec2.NewSecurityGroup(ctx, "ssm-endpoints-sg", &ec2.SecurityGroupArgs{
+		Description: pulumi.String("HTTPS from the VPC to the SSM endpoints"),
+		VpcId:       netResources.vpc.ID(),
+		Ingress: ec2.SecurityGroupIngressArray{
+			ec2.SecurityGroupIngressArgs{
+				Protocol:   pulumi.String("tcp"),
+				FromPort:   pulumi.Int(443),
+				ToPort:     pulumi.Int(443),
+				CidrBlocks: pulumi.StringArray{netResources.vpc.CidrBlock},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, service := range ssmEndpointServices {
+		_, err = ec2.NewVpcEndpoint(ctx, service+"-endpoint", &ec2.VpcEndpointArgs{
+			VpcId:             netResources.vpc.ID(),
+			ServiceName:       pulumi.String(fmt.Sprintf("com.amazonaws.%s.%s", region.Name, service)),
+			VpcEndpointType:   pulumi.String("Interface"),
+			PrivateDnsEnabled: pulumi.Bool(true),
+			SubnetIds:         subnetIds,
+			SecurityGroupIds:  pulumi.StringArray{sg.ID()},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SSH access for teams that still need it, always limited to the given security groups: without them
+// EKS would open port 22 to the whole internet
+// Docs: https://docs.aws.amazon.com/eks/latest/APIReference/API_RemoteAccessConfig.html
+func nodeGroupRemoteAccess(ng *NodeGroup) (eks.NodeGroupRemoteAccessPtrInput, error) {
+	r := ng.RemoteAccess
+	if r == nil {
+		return nil, nil
+	}
+	if ng.LaunchTemplate != nil {
+		return nil, fmt.Errorf("node group %s: remoteAccess can't be combined with a launchTemplate, set launchTemplate.keyName instead", ng.Name)
+	}
+	if r.KeyName == "" || len(r.SourceSecurityGroupIds) == 0 {
+		return nil, fmt.Errorf("node group %s: remoteAccess needs a keyName and at least one sourceSecurityGroupIds entry", ng.Name)
+	}
+	return &eks.NodeGroupRemoteAccessArgs{
+		Ec2SshKey:              pulumi.String(r.KeyName),
+		SourceSecurityGroupIds: toPulumiStringArray(r.SourceSecurityGroupIds),
+	}, nil
+}
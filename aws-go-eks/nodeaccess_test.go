@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeAccess(t *testing.T) {
+	assert.NotContains(t, nodeRolePolicies(&NodeAccess{}), ssmManagedInstancePolicy)
+	assert.Contains(t, nodeRolePolicies(&NodeAccess{Ssm: true}), ssmManagedInstancePolicy)
+
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		vpc, err := ec2.NewVpc(ctx, "vpc", &ec2.VpcArgs{CidrBlock: pulumi.String("10.0.0.0/16")})
+		assert.NoError(t, err)
+		subnet, err := ec2.NewSubnet(ctx, "private", &ec2.SubnetArgs{VpcId: vpc.ID(), CidrBlock: pulumi.String("10.0.1.0/24")})
+		assert.NoError(t, err)
+		return setupSsmEndpoints(ctx, &networkResources{vpc: vpc, privSubnets: []*ec2.Subnet{subnet}})
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	for _, service := range ssmEndpointServices {
+		endpoint := m.inputs[service+"-endpoint"]
+		assert.Equal(t, "com.amazonaws.eu-west-1."+service, endpoint["serviceName"].StringValue())
+		assert.Equal(t, "Interface", endpoint["vpcEndpointType"].StringValue())
+		assert.True(t, endpoint["privateDnsEnabled"].BoolValue())
+		assert.Equal(t, "private_id", endpoint["subnetIds"].ArrayValue()[0].StringValue())
+	}
+	ingress := m.inputs["ssm-endpoints-sg"]["ingress"].ArrayValue()[0].ObjectValue()
+	assert.Equal(t, float64(443), ingress["fromPort"].NumberValue())
+	assert.Equal(t, "10.0.0.0/16", ingress["cidrBlocks"].ArrayValue()[0].StringValue(), "Only the VPC reaches the endpoints")
+
+	remote, err := nodeGroupRemoteAccess(&NodeGroup{Name: "ssh", RemoteAccess: &RemoteAccess{KeyName: "ops", SourceSecurityGroupIds: []string{"sg-123"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, &eks.NodeGroupRemoteAccessArgs{
+		Ec2SshKey:              pulumi.String("ops"),
+		SourceSecurityGroupIds: toPulumiStringArray([]string{"sg-123"}),
+	}, remote)
+
+	_, err = nodeGroupRemoteAccess(&NodeGroup{Name: "open", RemoteAccess: &RemoteAccess{KeyName: "ops"}})
+	assert.Error(t, err, "SSH should never be open to the internet")
+	_, err = nodeGroupRemoteAccess(&NodeGroup{Name: "lt", RemoteAccess: &RemoteAccess{KeyName: "ops", SourceSecurityGroupIds: []string{"sg-123"}}, LaunchTemplate: &LaunchTemplate{}})
+	assert.Error(t, err, "EKS rejects remoteAccess next to a launch template")
+}
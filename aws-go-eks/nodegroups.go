@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/autoscaling"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// EKS taint effects and their Kubernetes spelling, the latter is what cluster-autoscaler expects in node-template tags
+var taintEffects = map[string]string{
+	"NO_SCHEDULE":        "NoSchedule",
+	"NO_EXECUTE":         "NoExecute",
+	"PREFER_NO_SCHEDULE": "PreferNoSchedule",
+}
+
+// Label and taint of the on-demand groups reserved for cluster addons, the taint is the one EKS and most charts know
+const (
+	systemNodeLabel = "node-class"
+	systemNodeValue = "system"
+	systemTaintKey  = "CriticalAddonsOnly"
+)
+
+// The single node group stacks had before nodeGroups was a list, by its physical and logical name
+const (
+	legacyNodeGroupName    = "demo-eks-nodegroup-2"
+	legacyNodeGroupLogical = "node-group-2"
+)
+
+// Node group names only have to be unique per cluster, the prefix still tells the groups of several stacks apart
+// in the console and in their ASG names. The group carried over from the single node group keeps its name,
+// a new one would replace it.
+func nodeGroupName(settings *stackSettings, ng *NodeGroup) string {
+	if ng.Name == legacyNodeGroupName {
+		return ng.Name
+	}
+	return physicalName(settings, ng.Name, maxNodeGroupNameLength)
+}
+
+// The physical name is fixed, so a replacement has to delete the old group first or the create would conflict.
+// The group carried over from the single node group keeps its resource through an alias.
+func nodeGroupOptions(ng *NodeGroup, opts []pulumi.ResourceOption) []pulumi.ResourceOption {
+	res := append([]pulumi.ResourceOption{pulumi.DeleteBeforeReplace(true)}, opts...)
+	if ng.Name == legacyNodeGroupName {
+		res = append(res, pulumi.Aliases([]pulumi.Alias{{Name: pulumi.String(legacyNodeGroupLogical)}}))
+	}
+	return res
+}
+
+// A system group always runs on-demand capacity and only takes pods tolerating its taint
+func withSystemRole(ng NodeGroup) (NodeGroup, error) {
+	if !ng.System {
+		return ng, nil
+	}
+	if ng.CapacityType != "" && ng.CapacityType != "ON_DEMAND" {
+		return ng, fmt.Errorf("node group %s: system node groups run ON_DEMAND capacity, got %s", ng.Name, ng.CapacityType)
+	}
+	ng.CapacityType = "ON_DEMAND"
+	labels := map[string]string{systemNodeLabel: systemNodeValue}
+	for k, v := range ng.Labels {
+		labels[k] = v
+	}
+	ng.Labels = labels
+	ng.Taints = append([]Taint{{Key: systemTaintKey, Value: "true", Effect: "NO_SCHEDULE"}}, ng.Taints...)
+	return ng, nil
+}
+
+func validateCapacity(ng *NodeGroup) error {
+	if ng.CapacityType != "" && ng.CapacityType != "ON_DEMAND" && ng.CapacityType != "SPOT" {
+		return fmt.Errorf("node group %s: capacityType must be ON_DEMAND or SPOT, got %q", ng.Name, ng.CapacityType)
+	}
+	return nil
+}
+
+// Spot capacity for a single instance type dries up regularly, a spot group should be able to fall back on others
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/managed-node-groups.html#managed-node-group-capacity-types
+func capacityWarning(ng *NodeGroup) string {
+	if ng.CapacityType == "SPOT" && len(ng.InstanceTypes) < 2 {
+		return fmt.Sprintf("spot node group %s has a single instance type, add others of a similar size so it can still scale when that type runs out", ng.Name)
+	}
+	return ""
+}
+
+func hasSystemNodeGroup(nodeGroups []NodeGroup) bool {
+	for _, ng := range nodeGroups {
+		if ng.System {
+			return true
+		}
+	}
+	return false
+}
+
+func setupNodeGroups(ctx *pulumi.Context, settings *stackSettings, clusterName string, eksCluster *eks.Cluster, ca pulumi.StringOutput, nodeGroupRole *iam.Role, netResources *networkResources, nodeGroups []NodeGroup, opts ...pulumi.ResourceOption) ([]*eks.NodeGroup, error) {
+	res := []*eks.NodeGroup{}
+	for _, ng := range nodeGroups {
+		if ng.Name == "" {
+			return nil, fmt.Errorf("every node group needs a name")
+		}
+		ng, err := withSystemRole(ng)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateCapacity(&ng); err != nil {
+			return nil, err
+		}
+		if w := capacityWarning(&ng); w != "" {
+			ctx.Log.Warn(w, nil)
+		}
+
+		if _, err := nodeGroupArchitecture(&ng); err != nil {
+			return nil, err
+		}
+
+		subnetIds, err := nodeGroupSubnets(netResources, ng.Subnets)
+		if err != nil {
+			return nil, fmt.Errorf("node group %s: %w", ng.Name, err)
+		}
+
+		taints := eks.NodeGroupTaintArray{}
+		for _, t := range ng.Taints {
+			if _, ok := taintEffects[t.Effect]; !ok {
+				return nil, fmt.Errorf("node group %s: invalid taint effect %q for %s", ng.Name, t.Effect, t.Key)
+			}
+			taint := eks.NodeGroupTaintArgs{
+				Key:    pulumi.String(t.Key),
+				Effect: pulumi.String(t.Effect),
+			}
+			if t.Value != "" {
+				taint.Value = pulumi.String(t.Value)
+			}
+			taints = append(taints, taint)
+		}
+
+		autoscalerTags := nodeTemplateTags(clusterName, &ng)
+
+		releaseVersion, err := nodeGroupReleaseVersion(ctx, &ng, eksCluster)
+		if err != nil {
+			return nil, err
+		}
+		updateConfig, err := nodeGroupUpdateConfig(&ng)
+		if err != nil {
+			return nil, err
+		}
+		remoteAccess, err := nodeGroupRemoteAccess(&ng)
+		if err != nil {
+			return nil, err
+		}
+
+		nodeGroupArgs := &eks.NodeGroupArgs{
+			ClusterName:   eksCluster.Name,
+			NodeGroupName: pulumi.String(nodeGroupName(settings, &ng)),
+			NodeRoleArn:   pulumi.StringInput(nodeGroupRole.Arn),
+			InstanceTypes: toPulumiStringArray(ng.InstanceTypes),
+			CapacityType:  pulumi.String(capacityType(&ng)),
+			SubnetIds:     subnetIds,
+			ScalingConfig: &eks.NodeGroupScalingConfigArgs{
+				DesiredSize: pulumi.Int(ng.Scaling.Desire),
+				MaxSize:     pulumi.Int(ng.Scaling.Max),
+				MinSize:     pulumi.Int(ng.Scaling.Min),
+			},
+			Labels:         pulumi.ToStringMap(ng.Labels),
+			Taints:         taints,
+			Tags:           pulumi.ToStringMap(autoscalerTags),
+			ReleaseVersion: releaseVersion,
+			UpdateConfig:   updateConfig,
+			RemoteAccess:   remoteAccess,
+			// Drains nodes even when pod disruption budgets block it, otherwise the update fails
+			ForceUpdateVersion: pulumi.Bool(ng.ForceUpdateVersion),
+		}
+		if ng.LaunchTemplate != nil {
+			// Disk size moves into the template, and a custom AMI means the node group has no AMI type
+			lt, err := setupLaunchTemplate(ctx, &ng, eksCluster, ca)
+			if err != nil {
+				return nil, err
+			}
+			nodeGroupArgs.LaunchTemplate = nodeGroupLaunchTemplate(lt)
+			if ng.AmiType != "" && ng.LaunchTemplate.ImageId == "" {
+				nodeGroupArgs.AmiType = pulumi.String(ng.AmiType)
+			}
+		} else {
+			if ng.DiskSize > 0 {
+				nodeGroupArgs.DiskSize = pulumi.Int(ng.DiskSize)
+			}
+			if ng.AmiType != "" {
+				nodeGroupArgs.AmiType = pulumi.String(ng.AmiType)
+			}
+		}
+
+		var nodeGroup *eks.NodeGroup
+		if amiFamily(ng.AmiType) == "al2023" {
+			nodeGroup, err = newEksNodeGroup(ctx, ng.Name, nodeGroupArgs, nodeGroupOptions(&ng, opts)...)
+		} else {
+			nodeGroup, err = eks.NewNodeGroup(ctx, ng.Name, nodeGroupArgs, nodeGroupOptions(&ng, opts)...)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Managed node groups do not propagate their tags to the underlying ASG,
+		// but cluster-autoscaler reads them from there when scaling up from zero
+		asgName := nodeGroup.Resources.Index(pulumi.Int(0)).AutoscalingGroups().Index(pulumi.Int(0)).Name().Elem()
+		keys := make([]string, 0, len(autoscalerTags))
+		for k := range autoscalerTags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// Named after the tag key, so adding a label never shifts the other tags around
+			_, err = autoscaling.NewTag(ctx, fmt.Sprintf("%s-asg-tag-%s", ng.Name, k), &autoscaling.TagArgs{
+				AutoscalingGroupName: asgName,
+				Tag: &autoscaling.TagTagArgs{
+					Key:               pulumi.String(k),
+					Value:             pulumi.String(autoscalerTags[k]),
+					PropagateAtLaunch: pulumi.Bool(false),
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		res = append(res, nodeGroup)
+	}
+	return res, nil
+}
+
+// Auto discovery tags plus the node-template hints cluster-autoscaler uses to simulate nodes of an empty group
+// Docs: https://github.com/kubernetes/autoscaler/blob/master/cluster-autoscaler/cloudprovider/aws/README.md#auto-discovery-setup
+func nodeTemplateTags(clusterName string, ng *NodeGroup) map[string]string {
+	tags := map[string]string{
+		"k8s.io/cluster-autoscaler/" + clusterName: "owned",
+		"k8s.io/cluster-autoscaler/enabled":        "true",
+	}
+	// EKS labels every node with its capacity type, pods selecting on it must not block a scale up from zero
+	tags["k8s.io/cluster-autoscaler/node-template/label/eks.amazonaws.com/capacityType"] = capacityType(ng)
+	for k, v := range ng.Labels {
+		tags["k8s.io/cluster-autoscaler/node-template/label/"+k] = v
+	}
+	for _, t := range ng.Taints {
+		tags["k8s.io/cluster-autoscaler/node-template/taint/"+t.Key] = t.Value + ":" + taintEffects[t.Effect]
+	}
+	return tags
+}
+
+func capacityType(ng *NodeGroup) string {
+	if ng.CapacityType == "" {
+		return "ON_DEMAND"
+	}
+	return ng.CapacityType
+}
+
+// Priority expander config: spot groups are tried first, then the on-demand ones, system groups only as a last resort
+// Docs: https://github.com/kubernetes/autoscaler/blob/master/cluster-autoscaler/expander/priority/readme.md
+const nodeGroupIdPattern = "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
+
+func expanderPriorities(settings *stackSettings, nodeGroups []NodeGroup) map[int][]string {
+	priorities := map[int][]string{}
+	for _, ng := range nodeGroups {
+		priority := 20
+		switch {
+		case ng.System:
+			priority = 1
+		case ng.CapacityType == "SPOT":
+			priority = 50
+		}
+		// Managed node group ASGs are named eks-<node group name>-<node group id>, anchored on both ends
+		// so a group named spot doesn't also match spot-large
+		name := nodeGroupName(settings, &ng)
+		priorities[priority] = append(priorities[priority], fmt.Sprintf("^eks-%s-%s$", regexp.QuoteMeta(name), nodeGroupIdPattern))
+	}
+	return priorities
+}
+
+func nodeGroupSubnets(netResources *networkResources, selection string) (pulumi.StringArray, error) {
+	subnetIds := pulumi.StringArray{}
+	switch selection {
+	case "", "private":
+		for _, v := range netResources.privSubnets {
+			subnetIds = append(subnetIds, v.ID())
+		}
+	case "public":
+		for _, v := range netResources.pubSubnets {
+			subnetIds = append(subnetIds, v.ID())
+		}
+	default:
+		return nil, fmt.Errorf("unknown subnet selection %q, use private or public", selection)
+	}
+	return subnetIds, nil
+}
+
+func nodeGroupDeps(nodeGroups []*eks.NodeGroup) []pulumi.Resource {
+	deps := []pulumi.Resource{}
+	for _, ng := range nodeGroups {
+		deps = append(deps, ng)
+	}
+	return deps
+}
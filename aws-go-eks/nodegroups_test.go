@@ -0,0 +1,41 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeGroupCapacity(t *testing.T) {
+	system, err := withSystemRole(NodeGroup{Name: "system", System: true, Labels: map[string]string{"team": "platform"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "ON_DEMAND", system.CapacityType)
+	assert.Equal(t, map[string]string{"team": "platform", systemNodeLabel: systemNodeValue}, system.Labels)
+	assert.Equal(t, []Taint{{systemTaintKey, "true", "NO_SCHEDULE"}}, system.Taints)
+
+	_, err = withSystemRole(NodeGroup{Name: "system", System: true, CapacityType: "SPOT"})
+	assert.Error(t, err)
+	assert.Error(t, validateCapacity(&NodeGroup{Name: "spot", CapacityType: "spot"}))
+	single := NodeGroup{Name: "spot", CapacityType: "SPOT", InstanceTypes: []string{"t3.medium"}}
+	assert.NoError(t, validateCapacity(&single), "A single spot instance type is allowed")
+	assert.NotEmpty(t, capacityWarning(&single), "but warned about")
+	assert.Empty(t, capacityWarning(&NodeGroup{Name: "spot", CapacityType: "SPOT", InstanceTypes: []string{"t3.medium", "t3a.medium"}}))
+
+	settings := &stackSettings{NamePrefix: "dev"}
+	priorities := expanderPriorities(settings, []NodeGroup{
+		{Name: "system", System: true},
+		{Name: "spot", CapacityType: "SPOT"},
+		{Name: "on-demand"},
+		{Name: legacyNodeGroupName},
+	})
+	assert.Equal(t, map[int][]string{
+		1:  {"^eks-dev-system-" + nodeGroupIdPattern + "$"},
+		50: {"^eks-dev-spot-" + nodeGroupIdPattern + "$"},
+		20: {"^eks-dev-on-demand-" + nodeGroupIdPattern + "$", "^eks-demo-eks-nodegroup-2-" + nodeGroupIdPattern + "$"},
+	}, priorities)
+
+	spot := regexp.MustCompile(priorities[50][0])
+	assert.True(t, spot.MatchString("eks-dev-spot-52c4a0f5-2e1a-4c2b-9d3e-0f1e2d3c4b5a"))
+	assert.False(t, spot.MatchString("eks-dev-spot-large-52c4a0f5-2e1a-4c2b-9d3e-0f1e2d3c4b5a"), "spot should not match spot-large")
+}
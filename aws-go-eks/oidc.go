@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// The IAM OIDC provider of the cluster, issuer is the host and path of the issuer URL as used in trust conditions
+type oidcProvider struct {
+	arn    pulumi.StringOutput
+	issuer pulumi.StringOutput
+}
+
+func oidcIssuerHost(url string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(url, "https://"), "/")
+}
+
+// An adopted provider has to be for the cluster issuer, and accept the audience of the tokens STS is handed
+func checkOidcProvider(arn string, url string, clientIds []string, issuer string) error {
+	if host := oidcIssuerHost(url); host != issuer {
+		return fmt.Errorf("OIDC provider %s is for %s, not for the cluster issuer %s", arn, host, issuer)
+	}
+	if !contains(clientIds, "sts.amazonaws.com") {
+		return fmt.Errorf("OIDC provider %s doesn't list sts.amazonaws.com as a client ID, IRSA tokens would be rejected", arn)
+	}
+	return nil
+}
+
+// Resource: IAM OpenID Connect Provider
+// Purpose: Lets service accounts of the cluster assume IAM roles (IRSA). With eks.oidcProviderArn an existing provider
+// for the same issuer is used instead, e.g. one left behind by an earlier stack of the same cluster; the program checks
+// that it really belongs to the cluster but doesn't manage it.
+// Docs: https://docs.aws.amazon.com/eks/latest/userguide/enable-iam-roles-for-service-accounts.html
+func setupOidcProvider(ctx *pulumi.Context, eksCluster *eks.Cluster, eksConfig *eksConfig) (*oidcProvider, error) {
+	issuerUrl := eksCluster.Identities.Index(pulumi.Int(0)).Oidcs().Index(pulumi.Int(0)).Issuer().Elem().ToStringOutput()
+	issuer := issuerUrl.ApplyT(oidcIssuerHost).(pulumi.StringOutput)
+
+	if eksConfig.OidcProviderArn != "" {
+		existing, err := iam.GetOpenIdConnectProvider(ctx, "eks-oidc-existing", pulumi.ID(eksConfig.OidcProviderArn), nil)
+		if err != nil {
+			return nil, err
+		}
+		arn := pulumi.All(existing.Arn, existing.Url, existing.ClientIdLists, issuer).ApplyT(func(args []interface{}) (string, error) {
+			arn := args[0].(string)
+			return arn, checkOidcProvider(arn, args[1].(string), args[2].([]string), args[3].(string))
+		}).(pulumi.StringOutput)
+		return &oidcProvider{arn: arn, issuer: issuer}, nil
+	}
+
+	thumbprint, err := oidcThumbprint(eksConfig.OidcThumbprint, issuerUrl)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := iam.NewOpenIdConnectProvider(ctx, "eks-oidc", &iam.OpenIdConnectProviderArgs{
+		ClientIdLists:   pulumi.StringArray{pulumi.String("sts.amazonaws.com")},
+		ThumbprintLists: pulumi.StringArray{thumbprint},
+		Url:             issuerUrl,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &oidcProvider{arn: provider.Arn, issuer: issuer}, nil
+}
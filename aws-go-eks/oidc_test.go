@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOidcProvider(t *testing.T) {
+	arn := "arn:aws:iam::123456789012:oidc-provider/oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLE"
+	issuer := "oidc.eks.eu-west-1.amazonaws.com/id/EXAMPLE"
+
+	assert.NoError(t, checkOidcProvider(arn, issuer, []string{"sts.amazonaws.com"}, issuer))
+	assert.Error(t, checkOidcProvider(arn, "oidc.eks.eu-west-1.amazonaws.com/id/OTHER", []string{"sts.amazonaws.com"}, issuer))
+	assert.Error(t, checkOidcProvider(arn, issuer, []string{"sigstore"}, issuer), "IRSA needs the sts.amazonaws.com audience")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+var stringMapInputType = reflect.TypeOf((*pulumi.StringMapInput)(nil)).Elem()
+
+// Stack wide settings from the top level namePrefix, tags and resourceTags config keys
+func loadStackSettings(ctx *pulumi.Context, conf *config.Config) (*stackSettings, error) {
+	settings := &stackSettings{NamePrefix: conf.Get("namePrefix")}
+	if settings.NamePrefix == "" {
+		settings.NamePrefix = ctx.Project() + "-" + ctx.Stack()
+	}
+	// Both are optional, TryObject only fails on a missing key or a value of the wrong shape
+	if conf.Get("tags") != "" {
+		if err := conf.TryObject("tags", &settings.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Get("resourceTags") != "" {
+		if err := conf.TryObject("resourceTags", &settings.ResourceTags); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// Resource: Stack transformation
+// Purpose: Tags every taggable AWS resource of the stack, so no resource has to remember to pass the common tags.
+// The project and stack tags come first, then the configured tags, the resource's own tags and last the
+// resourceTags override for its logical name.
+// Docs: https://www.pulumi.com/docs/concepts/options/transformations/
+func registerTagTransformation(ctx *pulumi.Context, settings *stackSettings) error {
+	defaults := map[string]string{
+		"pulumi:project": ctx.Project(),
+		"pulumi:stack":   ctx.Stack(),
+	}
+	for k, v := range settings.Tags {
+		defaults[k] = v
+	}
+
+	return ctx.RegisterStackTransformation(func(args *pulumi.ResourceTransformationArgs) *pulumi.ResourceTransformationResult {
+		if !strings.HasPrefix(args.Type, "aws:") {
+			return nil
+		}
+		overrides := settings.ResourceTags[args.Name]
+
+		// Generated args, and the typed args in awsnext.go, are pointers to structs; taggable ones have a Tags string map
+		v := reflect.ValueOf(args.Props)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		field := v.Elem().FieldByName("Tags")
+		if !field.IsValid() || field.Type() != stringMapInputType {
+			return nil
+		}
+		own, _ := field.Interface().(pulumi.StringMapInput)
+		field.Set(reflect.ValueOf(mergeTags(defaults, own, overrides)))
+		return &pulumi.ResourceTransformationResult{Props: args.Props, Opts: args.Opts}
+	})
+}
+
+func mergeTags(defaults map[string]string, own pulumi.StringMapInput, overrides map[string]string) pulumi.StringMapInput {
+	if own == nil {
+		own = pulumi.StringMap{}
+	}
+	return own.ToStringMapOutput().ApplyT(func(tags map[string]string) map[string]string {
+		res := map[string]string{}
+		for _, m := range []map[string]string{defaults, tags, overrides} {
+			for k, v := range m {
+				res[k] = v
+			}
+		}
+		return res
+	}).(pulumi.StringMapOutput)
+}
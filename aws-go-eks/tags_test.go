@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagTransformation(t *testing.T) {
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		settings := &stackSettings{
+			Tags:         map[string]string{"Team": "platform", "Name": "default"},
+			ResourceTags: map[string]map[string]string{"tagged-vpc": {"Tier": "network"}},
+		}
+		assert.NoError(t, registerTagTransformation(ctx, settings))
+
+		vpc, err := ec2.NewVpc(ctx, "tagged-vpc", &ec2.VpcArgs{
+			CidrBlock: pulumi.String("10.0.0.0/16"),
+			Tags:      pulumi.StringMap{"Name": pulumi.String("own")},
+		})
+		assert.NoError(t, err)
+		eip, err := ec2.NewEip(ctx, "untagged-eip", &ec2.EipArgs{})
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		vpc.Tags.ApplyT(func(tags map[string]string) error {
+			assert.Equal(t, map[string]string{
+				"pulumi:project": "project",
+				"pulumi:stack":   "stack",
+				"Team":           "platform",
+				"Name":           "own",
+				"Tier":           "network",
+			}, tags)
+			wg.Done()
+			return nil
+		})
+		eip.Tags.ApplyT(func(tags map[string]string) error {
+			assert.Equal(t, "default", tags["Name"])
+			assert.NotContains(t, tags, "Tier")
+			wg.Done()
+			return nil
+		})
+		wg.Wait()
+		return nil
+	}, pulumi.WithMocks("project", "stack", mocks(0)))
+	assert.NoError(t, err)
+}
+
+func TestTagTransformationNextTypes(t *testing.T) {
+	m := &recordingMocks{}
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		assert.NoError(t, registerTagTransformation(ctx, &stackSettings{Tags: map[string]string{"Team": "platform"}}))
+		_, err := newEksAddon(ctx, "addon-vpc-cni", &eksAddonArgs{
+			AddonName:   pulumi.String("vpc-cni"),
+			ClusterName: pulumi.String("test"),
+		})
+		assert.NoError(t, err)
+		_, err = newEksAccessEntry(ctx, "access-role-admins", &eksAccessEntryArgs{
+			ClusterName:  pulumi.String("test"),
+			PrincipalArn: pulumi.String("arn:aws:iam::123456789012:role/admins"),
+			Tags:         pulumi.StringMap{"Owner": pulumi.String("ops")},
+		})
+		assert.NoError(t, err)
+		_, err = newEksPodIdentityAssociation(ctx, "app-pod-identity", &eksPodIdentityAssociationArgs{
+			ClusterName:    pulumi.String("test"),
+			Namespace:      pulumi.String("apps"),
+			ServiceAccount: pulumi.String("app"),
+			RoleArn:        pulumi.String("arn:aws:iam::123456789012:role/app"),
+		})
+		assert.NoError(t, err)
+		return nil
+	}, pulumi.WithMocks("project", "stack", m))
+	assert.NoError(t, err)
+
+	for _, name := range []string{"addon-vpc-cni", "access-role-admins", "app-pod-identity"} {
+		tags := m.inputs[name]["tags"].ObjectValue()
+		assert.Equal(t, "platform", tags["Team"].StringValue(), "%s should get the stack tags", name)
+		assert.Equal(t, "stack", tags["pulumi:stack"].StringValue())
+	}
+	assert.Equal(t, "ops", m.inputs["access-role-admins"]["tags"].ObjectValue()["Owner"].StringValue())
+}
+
+func TestPhysicalName(t *testing.T) {
+	settings := &stackSettings{NamePrefix: "aws-go-eks-staging"}
+	assert.Equal(t, "aws-go-eks-staging-eks", physicalName(settings, "eks", maxClusterNameLength))
+
+	long := physicalName(settings, strings.Repeat("x", 100), maxQueueNameLength)
+	assert.Len(t, long, maxQueueNameLength)
+	assert.Equal(t, long, physicalName(settings, strings.Repeat("x", 100), maxQueueNameLength))
+	assert.NotEqual(t, long, physicalName(settings, strings.Repeat("x", 101), maxQueueNameLength))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+var thumbprintFormat = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Fetches the thumbprint IAM expects for an OIDC issuer, Roots is nil for the system roots
+type thumbprintFetcher struct {
+	Roots    *x509.CertPool
+	Attempts int
+	Backoff  time.Duration
+	Timeout  time.Duration
+}
+
+// Five attempts over roughly half a minute, the issuer endpoint can lag behind a freshly created cluster
+var defaultThumbprintFetcher = thumbprintFetcher{Attempts: 5, Backoff: 2 * time.Second, Timeout: 10 * time.Second}
+
+// Retries with exponential backoff and returns the last error when every attempt failed
+func (f thumbprintFetcher) fetch(issuer string) (string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return "", fmt.Errorf("OIDC issuer %q is not an https URL", issuer)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	backoff := f.Backoff
+	for attempt := 1; ; attempt++ {
+		thumbprint, err := f.attempt(u.Hostname(), addr)
+		if err == nil {
+			return thumbprint, nil
+		}
+		if attempt >= f.Attempts {
+			return "", fmt.Errorf("getting the thumbprint of %s failed after %d attempts: %w", issuer, attempt, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// The handshake verifies the served chain, the thumbprint is the one of the top intermediate CA, or of the root
+// when the chain has no intermediate.
+// Docs: https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles_providers_create_oidc_verify-thumbprint.html
+func (f thumbprintFetcher) attempt(host string, addr string) (string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: f.Timeout}, "tcp", addr, &tls.Config{
+		ServerName: host,
+		RootCAs:    f.Roots,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", errors.New("the TLS handshake returned no verified certificate chain")
+	}
+	chain := chains[0]
+	top := chain[len(chain)-1]
+	if len(chain) > 2 {
+		top = chain[len(chain)-2]
+	}
+	return fmt.Sprintf("%x", sha1.Sum(top.Raw)), nil
+}
+
+// The eks.oidcThumbprint override skips the lookup, for previews and deployments without access to the issuer
+func oidcThumbprint(override string, issuer pulumi.StringOutput) (pulumi.StringOutput, error) {
+	if override != "" {
+		override = strings.ToLower(strings.ReplaceAll(override, ":", ""))
+		if !thumbprintFormat.MatchString(override) {
+			return pulumi.StringOutput{}, fmt.Errorf("oidcThumbprint %q is not a hex encoded SHA-1 fingerprint", override)
+		}
+		return pulumi.String(override).ToStringOutput(), nil
+	}
+	return issuer.ApplyT(func(url string) (string, error) {
+		return defaultThumbprintFetcher.fetch(url)
+	}).(pulumi.StringOutput), nil
+}
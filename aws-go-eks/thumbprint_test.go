@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !isCA {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestThumbprint(t *testing.T) {
+	root, rootKey := testCertificate(t, "root", true, nil, nil)
+	intermediate, intermediateKey := testCertificate(t, "intermediate", true, root, rootKey)
+	leaf, leafKey := testCertificate(t, "leaf", false, intermediate, intermediateKey)
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Raw, intermediate.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	fetcher := thumbprintFetcher{Roots: roots, Attempts: 2, Backoff: time.Millisecond, Timeout: time.Second}
+
+	thumbprint, err := fetcher.fetch(server.URL + "/id/EXAMPLE")
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha1.Sum(intermediate.Raw)), thumbprint, "The top intermediate should be used")
+
+	// A chain that doesn't verify is an error, not an empty thumbprint
+	fetcher.Roots = x509.NewCertPool()
+	_, err = fetcher.fetch(server.URL)
+	assert.Error(t, err)
+
+	_, err = oidcThumbprint("not-a-thumbprint", pulumi.String("https://example.com").ToStringOutput())
+	assert.Error(t, err)
+}